@@ -31,6 +31,7 @@ mkdir -p %buildroot/etc/cboxgroupd
 mkdir -p %buildroot/etc/logrotate.d
 mkdir -p %buildroot/usr/lib/systemd/system
 mkdir -p %buildroot/var/log/cboxgroupd
+mkdir -p %buildroot/var/lib/cboxgroupd
 install -m 755 cboxgroupd	     %buildroot/usr/local/bin/cboxgroupd
 install -m 644 cboxgroupd.service    %buildroot/usr/lib/systemd/system/cboxgroupd.service
 install -m 644 cboxgroupd.yaml       %buildroot/etc/cboxgroupd/cboxgroupd.yaml
@@ -48,6 +49,7 @@ rm -rf %buildroot/
 /etc/cboxgroupd
 /etc/logrotate.d/cboxgroupd
 /var/log/cboxgroupd
+/var/lib/cboxgroupd
 /usr/lib/systemd/system/cboxgroupd.service
 /usr/local/bin/*
 %config(noreplace) /etc/cboxgroupd/cboxgroupd.yaml
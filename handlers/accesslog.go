@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg/metrics"
+	"io"
+	"net/http"
+	"time"
+)
+
+// AccessLog writes a line per request in Common Log Format to out, like
+// gorilla's LoggingHandler, with the name of the authenticated client as the user.
+func AccessLog(out io.Writer, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		c := &requestClient{}
+		rec := metrics.NewStatusRecorder(w)
+		handler.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), clientKey{}, c)))
+
+		host := remoteHost(r)
+		user := "-"
+		if c.name != "" {
+			user = c.name
+		}
+
+		line := fmt.Sprintf("%s - %s [%s] %q %d %d\n",
+			host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto, rec.Status, rec.Size)
+		io.WriteString(out, line)
+	})
+}
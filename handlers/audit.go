@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"context"
+	"github.com/cernbox/cboxgroupd/pkg/audit"
+	"github.com/cernbox/cboxgroupd/pkg/metrics"
+	"go.uber.org/zap"
+	"net/http"
+	"path"
+	"time"
+)
+
+// Audit returns a middleware that records in log the requests changing something,
+// all but GET and HEAD, with the authenticated client, the groups, users or filters
+// of the request and its outcome. A nil log records nothing.
+// It goes before Authenticate so that the failed authentications are recorded too,
+// with an empty client.
+func Audit(logger *zap.Logger, log *audit.Log) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		if log == nil {
+			return handler
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			// the client is authenticated further down the chain, or not at all
+			c, ok := r.Context().Value(clientKey{}).(*requestClient)
+			if !ok {
+				c = &requestClient{}
+				r = r.WithContext(context.WithValue(r.Context(), clientKey{}, c))
+			}
+			e := &audit.Event{
+				Time:      time.Now().UTC(),
+				RequestID: RequestIDFromContext(r.Context()),
+				Remote:    remoteHost(r),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+			}
+			if req, err := peekUpdate(r); err == nil {
+				e.Groups, e.Users, e.Filters = req.Groups, req.Users, req.Filters
+			}
+
+			rec := metrics.NewStatusRecorder(w)
+			handler.ServeHTTP(rec, r)
+
+			e.Client = c.name
+			e.Status = rec.Status
+			e.Outcome = audit.Outcome(rec.Status)
+			if location := rec.Header().Get("Location"); location != "" {
+				e.Job = path.Base(location)
+			}
+			if err := log.Record(e); err != nil {
+				logger.Error("error writing audit log", zap.Error(err), zap.String("client", e.Client), zap.String("path", e.Path))
+			}
+		})
+	}
+}
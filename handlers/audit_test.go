@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/cernbox/cboxgroupd/pkg/audit"
+	"github.com/cernbox/cboxgroupd/pkg/clients"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	var out bytes.Buffer
+	h := Audit(zap.NewNop(), audit.New(&out))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "usersingroup") {
+			w.Header().Set("Location", "/api/v1/jobs/42")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+
+	requests := []*http.Request{
+		httptest.NewRequest("POST", "/api/v1/update/usersingroup", strings.NewReader(`{"groups":["cernbox-admins"]}`)),
+		httptest.NewRequest("GET", "/api/v1/jobs/42", nil),
+		httptest.NewRequest("DELETE", "/api/v1/admin/cachestats", nil),
+	}
+	for _, req := range requests {
+		req = req.WithContext(WithClient(req.Context(), "ops"))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 events, got %q", out.String())
+	}
+	var update, reset audit.Event
+	if err := json.Unmarshal([]byte(lines[0]), &update); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &reset); err != nil {
+		t.Fatal(err)
+	}
+	if update.Client != "ops" || update.Path != "/api/v1/update/usersingroup" || len(update.Groups) != 1 || update.Groups[0] != "cernbox-admins" ||
+		update.Job != "42" || update.Status != http.StatusAccepted || update.Outcome != "accepted" || update.Time.IsZero() {
+		t.Errorf("unexpected update event: %s", lines[0])
+	}
+	if reset.Method != "DELETE" || reset.Status != http.StatusForbidden || reset.Outcome != "denied" {
+		t.Errorf("unexpected reset event: %s", lines[1])
+	}
+}
+
+func TestAuditFailedAuthentication(t *testing.T) {
+	registry, err := clients.New([]clients.Client{{Name: "ops", Secrets: []clients.Secret{{Secret: "s3cret"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	auth := Authenticate(zap.NewNop(), registry, nil, NewFailureLimiter(0, 0))
+	h := Audit(zap.NewNop(), audit.New(&out))(auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})))
+
+	for _, secret := range []string{"wrong", "s3cret"} {
+		req := httptest.NewRequest("POST", "/api/v1/update/usersingroup", strings.NewReader(`{"groups":["cernbox-admins"]}`))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 events, got %q", out.String())
+	}
+	var failed, accepted audit.Event
+	if err := json.Unmarshal([]byte(lines[0]), &failed); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &accepted); err != nil {
+		t.Fatal(err)
+	}
+	if failed.Client != "" || failed.Status != http.StatusUnauthorized || failed.Outcome != "unauthenticated" || len(failed.Groups) != 1 {
+		t.Errorf("unexpected event for the wrong secret: %s", lines[0])
+	}
+	if accepted.Client != "ops" || accepted.Outcome != "accepted" {
+		t.Errorf("unexpected event for the right secret: %s", lines[1])
+	}
+}
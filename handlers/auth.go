@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg/clients"
+	"github.com/cernbox/cboxgroupd/pkg/jwtauth"
+	"github.com/cernbox/cboxgroupd/pkg/metrics"
+	"go.uber.org/zap"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type clientKey struct{}
+
+// requestClient is stored in the request context by AccessLog so the name of the client
+// authenticated further down the handler chain can be written in the access log.
+type requestClient struct {
+	name string
+	// token is set for the clients authenticated by a JWT, restricted to its scopes
+	token  bool
+	scopes []string
+}
+
+// WithClient returns a context carrying the name of the authenticated client.
+func WithClient(ctx context.Context, name string) context.Context {
+	return withClient(ctx, &requestClient{name: name})
+}
+
+func withClient(ctx context.Context, client *requestClient) context.Context {
+	if c, ok := ctx.Value(clientKey{}).(*requestClient); ok {
+		*c = *client
+		return ctx
+	}
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFromContext returns the name of the authenticated client, if any.
+func ClientFromContext(ctx context.Context) (string, bool) {
+	c, ok := ctx.Value(clientKey{}).(*requestClient)
+	if !ok || c.name == "" {
+		return "", false
+	}
+	return c.name, true
+}
+
+// ClientCertificate identifies the clients by the subject of their verified TLS
+// certificate, using the subjects map from subject to client name.
+// Identified clients do not need to send a secret.
+func ClientCertificate(logger *zap.Logger, subjects map[string]string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only certificates verified against the client CA are trusted
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			subject := r.TLS.VerifiedChains[0][0].Subject.String()
+			if name, ok := subjects[subject]; ok {
+				r = r.WithContext(WithClient(r.Context(), name))
+			} else {
+				logger.Warn("unknown client certificate", zap.String("subject", subject))
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Authenticate returns a middleware that authenticates the client by one of its secrets,
+// or by a JWT if verifier is not nil, sent as Authorization: Bearer <secret or token>,
+// and stores its name in the request context.
+// The scheme is case-insensitive, the secret is compared exactly.
+// Sources with too many failures are answered 429 without checking their secret, see
+// FailureLimiter.Source for how the source is found behind a proxy.
+func Authenticate(logger *zap.Logger, registry *clients.Registry, verifier *jwtauth.Verifier, limiter *FailureLimiter) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// clients identified by their certificate do not need the secret
+			if _, ok := ClientFromContext(r.Context()); ok {
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			source := limiter.Source(r)
+			if retryAfter := limiter.Blocked(source); retryAfter > 0 {
+				logger.Warn("too many authentication failures", zap.String("remote", source))
+				metrics.AuthFailures.WithLabelValues("blocked").Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				writeError(w, r, codeLimitExceeded, "too many authentication failures")
+				return
+			}
+
+			token, ok := bearerToken(r.Header.Get("Authorization"))
+			if !ok {
+				logger.Warn("missing bearer token", zap.String("remote", source))
+				metrics.AuthFailures.WithLabelValues("missing").Inc()
+				limiter.Fail(source)
+				writeError(w, r, codeUnauthenticated, "missing bearer token")
+				return
+			}
+
+			if verifier != nil && jwtauth.LooksLikeJWT(token) {
+				id, err := verifier.Verify(token)
+				if err != nil {
+					logger.Warn("invalid token", zap.Error(err), zap.String("remote", source))
+					metrics.AuthFailures.WithLabelValues("token").Inc()
+					limiter.Fail(source)
+					writeError(w, r, codeUnauthenticated, "invalid token")
+					return
+				}
+				handler.ServeHTTP(w, r.WithContext(withClient(r.Context(), &requestClient{name: id.Name, token: true, scopes: id.Scopes})))
+				return
+			}
+
+			name, err := registry.Authenticate(token)
+			if err != nil {
+				logger.Warn("wrong secret", zap.Error(err), zap.String("client", name), zap.String("remote", source))
+				reason := "unknown"
+				if err == clients.ErrExpiredSecret {
+					reason = "expired"
+				}
+				metrics.AuthFailures.WithLabelValues(reason).Inc()
+				limiter.Fail(source)
+				writeError(w, r, codeUnauthenticated, "invalid secret")
+				return
+			}
+			handler.ServeHTTP(w, r.WithContext(WithClient(r.Context(), name)))
+		})
+	}
+}
+
+// RequireScope returns a middleware that answers 403 to the clients authenticated with a
+// JWT that does not grant scope. The clients authenticated by secret or certificate
+// are not restricted.
+func RequireScope(logger *zap.Logger, scope string) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c, ok := r.Context().Value(clientKey{}).(*requestClient); ok && c.token {
+				id := &jwtauth.Identity{Name: c.name, Scopes: c.scopes}
+				if !id.HasScope(scope) {
+					logger.Warn("missing scope", zap.String("client", c.name), zap.String("scope", scope))
+					writeError(w, r, codePermissionDenied, "token does not grant scope "+scope)
+					return
+				}
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bearerToken returns the token of an Authorization header with the Bearer scheme.
+func bearerToken(h string) (string, bool) {
+	i := strings.IndexByte(h, ' ')
+	if i < 0 || !strings.EqualFold(h[:i], "bearer") {
+		return "", false
+	}
+	token := strings.TrimLeft(h[i:], " ")
+	return token, token != ""
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// FailureLimiter blocks the sources with more than max authentication failures
+// within window, until the window ends.
+type FailureLimiter struct {
+	max    int
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	proxies []*net.IPNet
+	sources map[string]*failures
+}
+
+type failures struct {
+	start time.Time
+	count int
+}
+
+// NewFailureLimiter returns a FailureLimiter, max zero disables it.
+func NewFailureLimiter(max int, window time.Duration) *FailureLimiter {
+	return &FailureLimiter{max: max, window: window, now: time.Now, sources: map[string]*failures{}}
+}
+
+// ParseProxies parses a list of addresses and CIDR ranges, like 10.0.0.7 or 10.0.0.0/24.
+func ParseProxies(list []string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %q", s)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For header is trusted.
+func (l *FailureLimiter) SetTrustedProxies(proxies []*net.IPNet) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.proxies = proxies
+}
+
+// Source returns the address the failures of r are counted for: the remote address or,
+// behind a trusted proxy, the last address of X-Forwarded-For not added by a trusted proxy.
+// Without trusted proxies all the clients behind a load balancer would share its address.
+func (l *FailureLimiter) Source(r *http.Request) string {
+	source := remoteHost(r)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.trusted(source) {
+		return source
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		source = hop
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return source
+}
+
+// trusted tells whether host is one of the trusted proxies, l.mu must be held.
+func (l *FailureLimiter) trusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Janitor forgets the sources whose window has ended, every window until done is closed,
+// so that the sources failing once do not stay in memory.
+func (l *FailureLimiter) Janitor(done <-chan struct{}) {
+	if l.max <= 0 || l.window <= 0 {
+		return
+	}
+	ticker := time.NewTicker(l.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.prune()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (l *FailureLimiter) prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for s, f := range l.sources {
+		if now.Sub(f.start) >= l.window {
+			delete(l.sources, s)
+		}
+	}
+}
+
+// Fail records an authentication failure of source.
+func (l *FailureLimiter) Fail(source string) {
+	if l.max <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	f, ok := l.sources[source]
+	if !ok || now.Sub(f.start) >= l.window {
+		f = &failures{start: now}
+		l.sources[source] = f
+	}
+	f.count++
+}
+
+// Blocked returns how long source stays blocked, zero if it is not.
+func (l *FailureLimiter) Blocked(source string) time.Duration {
+	if l.max <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.sources[source]
+	if !ok || f.count < l.max {
+		return 0
+	}
+	left := f.start.Add(l.window).Sub(l.now())
+	if left <= 0 {
+		return 0
+	}
+	return left
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/cernbox/cboxgroupd/pkg/clients"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogWithClient(t *testing.T) {
+	registry, err := clients.New([]clients.Client{{Name: "web", Secrets: []clients.Secret{{Secret: "s3cret"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	auth := Authenticate(zap.NewNop(), registry, nil, NewFailureLimiter(0, 0))
+	h := AccessLog(&out, auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	})))
+
+	for _, auth := range []string{"Bearer s3cret", "Bearer S3CRET"} {
+		req := httptest.NewRequest("GET", "/api/v1/membership/usergroups/hugo", nil)
+		req.Header.Set("Authorization", auth)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", out.String())
+	}
+	if !strings.Contains(lines[0], " - web [") || !strings.HasSuffix(lines[0], `"GET /api/v1/membership/usergroups/hugo HTTP/1.1" 200 2`) {
+		t.Errorf("unexpected line for authenticated client: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], " - - [") || !strings.Contains(lines[1], `HTTP/1.1" 401 `) {
+		t.Errorf("unexpected line for wrong secret: %s", lines[1])
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	registry, err := clients.New([]clients.Client{{Name: "web", Secrets: []clients.Secret{{Secret: "S3cret"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Authenticate(zap.NewNop(), registry, nil, NewFailureLimiter(0, 0))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _ := ClientFromContext(r.Context())
+		w.Write([]byte(name))
+	}))
+
+	tests := []struct {
+		header string
+		code   int
+	}{
+		{"Bearer S3cret", http.StatusOK},
+		{"bearer S3cret", http.StatusOK},
+		{"BEARER  S3cret", http.StatusOK},
+		{"Bearer s3cret", http.StatusUnauthorized},
+		{"BEARER S3CRET", http.StatusUnauthorized},
+		{"Bearer S3cret ", http.StatusUnauthorized},
+		{"Basic S3cret", http.StatusUnauthorized},
+		{"BearerS3cret", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", test.header)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%q: expected %d, got %d", test.header, test.code, rec.Code)
+		}
+		if rec.Code == http.StatusOK && rec.Body.String() != "web" {
+			t.Errorf("%q: expected client web, got %q", test.header, rec.Body.String())
+		}
+	}
+}
+
+func TestFailureLimiter(t *testing.T) {
+	registry, err := clients.New([]clients.Client{{Name: "web", Secrets: []clients.Secret{{Secret: "s3cret"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	limiter := NewFailureLimiter(3, time.Minute)
+	limiter.now = func() time.Time { return now }
+	h := Authenticate(zap.NewNop(), registry, nil, limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	do := func(remote, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote + ":12345"
+		req.Header.Set("Authorization", "Bearer "+secret)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := do("10.0.0.1", "guess"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d", rec.Code)
+		}
+	}
+	// blocked even with the right secret, other sources are not affected
+	rec := do("10.0.0.1", "s3cret")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected 429 with Retry-After 60, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := do("10.0.0.2", "s3cret"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for another source, got %d", rec.Code)
+	}
+
+	now = now.Add(time.Minute)
+	if rec := do("10.0.0.1", "s3cret"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 after the window, got %d", rec.Code)
+	}
+}
+
+func TestFailureLimiterSource(t *testing.T) {
+	limiter := NewFailureLimiter(3, time.Minute)
+	proxies, err := ParseProxies([]string{"10.0.0.7", "192.168.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.SetTrustedProxies(proxies)
+
+	tests := []struct {
+		remote, forwarded, source string
+	}{
+		{"10.0.0.1", "", "10.0.0.1"},
+		// only the trusted proxies can set the source
+		{"10.0.0.1", "172.16.0.1", "10.0.0.1"},
+		{"10.0.0.7", "", "10.0.0.7"},
+		{"10.0.0.7", "172.16.0.1", "172.16.0.1"},
+		// the client can prepend anything, the last untrusted hop is the source
+		{"10.0.0.7", "1.2.3.4, 172.16.0.1, 192.168.0.3", "172.16.0.1"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote + ":12345"
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if source := limiter.Source(req); source != test.source {
+			t.Errorf("%s forwarding %q: expected %s, got %s", test.remote, test.forwarded, test.source, source)
+		}
+	}
+
+	if _, err := ParseProxies([]string{"10.0.0.300"}); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+	if _, err := ParseProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an error for an invalid range")
+	}
+}
+
+func TestFailureLimiterPrune(t *testing.T) {
+	now := time.Now()
+	limiter := NewFailureLimiter(3, time.Minute)
+	limiter.now = func() time.Time { return now }
+	limiter.Fail("10.0.0.1")
+	now = now.Add(30 * time.Second)
+	limiter.Fail("10.0.0.2")
+
+	now = now.Add(30 * time.Second)
+	limiter.prune()
+	if _, ok := limiter.sources["10.0.0.1"]; ok {
+		t.Error("expected the ended window to be pruned")
+	}
+	if _, ok := limiter.sources["10.0.0.2"]; !ok {
+		t.Error("expected the current window to be kept")
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	h := RequireScope(zap.NewNop(), "groups:update")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		client *requestClient
+		code   int
+	}{
+		{"secret", &requestClient{name: "web"}, http.StatusOK},
+		{"token with scope", &requestClient{name: "web", token: true, scopes: []string{"groups:read", "groups:update"}}, http.StatusOK},
+		{"token without scope", &requestClient{name: "web", token: true, scopes: []string{"groups:read"}}, http.StatusForbidden},
+		{"token without scopes", &requestClient{name: "web", token: true}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/api/v1/update/usergroups", nil)
+		req = req.WithContext(withClient(req.Context(), test.client))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+)
+
+// batchResponse is the answer of the batch routes: the members or groups of every group
+// or user of the request, or the error looking it up.
+type batchResponse struct {
+	Results map[string][]string `json:"results"`
+	Errors  map[string]*Error   `json:"errors"`
+}
+
+type batchLookup func(ctx context.Context, ids []string) map[string]*pkg.BatchResult
+
+// BatchUsersInGroup answers the members of all the e-groups in the groups of the body.
+// Cache backends implementing pkg.BatchGroupLooker look them up at once, with the others
+// the groups are looked up one by one, concurrency at a time.
+func BatchUsersInGroup(logger *zap.Logger, groupLooker pkg.GroupLooker, maxItems, concurrency int) http.Handler {
+	return batch(logger, "groups", maxItems, func(ctx context.Context, gids []string) map[string]*pkg.BatchResult {
+		if bgl, ok := groupLooker.(pkg.BatchGroupLooker); ok {
+			return bgl.GetUsersInGroups(ctx, gids, concurrency)
+		}
+		return pkg.Batch(ctx, gids, concurrency, cachedLookup(groupLooker.GetUsersInGroup))
+	})
+}
+
+// BatchUsersInComputingGroup answers the members of all the computing groups in the groups of the body.
+func BatchUsersInComputingGroup(logger *zap.Logger, groupLooker pkg.GroupLooker, maxItems, concurrency int) http.Handler {
+	return batch(logger, "groups", maxItems, func(ctx context.Context, gids []string) map[string]*pkg.BatchResult {
+		if bgl, ok := groupLooker.(pkg.BatchGroupLooker); ok {
+			return bgl.GetUsersInComputingGroups(ctx, gids, concurrency)
+		}
+		return pkg.Batch(ctx, gids, concurrency, cachedLookup(groupLooker.GetUsersInComputingGroup))
+	})
+}
+
+// BatchUserGroups answers the e-groups of all the users in the users of the body.
+func BatchUserGroups(logger *zap.Logger, groupLooker pkg.GroupLooker, maxItems, concurrency int) http.Handler {
+	return batch(logger, "users", maxItems, func(ctx context.Context, uids []string) map[string]*pkg.BatchResult {
+		if bgl, ok := groupLooker.(pkg.BatchGroupLooker); ok {
+			return bgl.GetGroupsOfUsers(ctx, uids, concurrency)
+		}
+		return pkg.Batch(ctx, uids, concurrency, cachedLookup(groupLooker.GetUserGroups))
+	})
+}
+
+// BatchUserComputingGroups answers the computing groups of all the users in the users of the body.
+func BatchUserComputingGroups(logger *zap.Logger, groupLooker pkg.GroupLooker, maxItems, concurrency int) http.Handler {
+	return batch(logger, "users", maxItems, func(ctx context.Context, uids []string) map[string]*pkg.BatchResult {
+		if bgl, ok := groupLooker.(pkg.BatchGroupLooker); ok {
+			return bgl.GetComputingGroupsOfUsers(ctx, uids, concurrency)
+		}
+		return pkg.Batch(ctx, uids, concurrency, cachedLookup(groupLooker.GetUserComputingGroups))
+	})
+}
+
+func cachedLookup(lookup func(ctx context.Context, id string, cached bool) ([]string, error)) func(ctx context.Context, id string) ([]string, error) {
+	return func(ctx context.Context, id string) ([]string, error) {
+		return lookup(ctx, id, true)
+	}
+}
+
+// batch reads the ids in the field of the body, groups or users, and answers what lookup
+// returns for them. Invalid ids, groups the policy of the client does not allow and failed
+// lookups are reported in the errors of the response, the other ids are answered anyway.
+// The groups of users are filtered by the policy of the client.
+func batch(logger *zap.Logger, field string, maxItems int, lookup batchLookup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logger.Error(err.Error())
+			writeError(w, r, codeInvalidArgument, "invalid request body: "+err.Error())
+			return
+		}
+		req := &updateRequest{}
+		if err := json.Unmarshal(data, req); err != nil {
+			logger.Error(err.Error())
+			writeError(w, r, codeInvalidArgument, "invalid request body: "+err.Error())
+			return
+		}
+		ids := req.Groups
+		if field == "users" {
+			ids = req.Users
+		}
+		if len(ids) == 0 {
+			writeError(w, r, codeInvalidArgument, "no "+field+" in the request")
+			return
+		}
+		if maxItems > 0 && len(ids) > maxItems {
+			logger.Warn("batch too large", zap.Int("items", len(ids)), zap.Int("max", maxItems))
+			writeError(w, r, codeTooLarge, fmt.Sprintf("at most %d %s per request", maxItems, field))
+			return
+		}
+
+		res := &batchResponse{Results: map[string][]string{}, Errors: map[string]*Error{}}
+		seen := map[string]bool{}
+		var valid []string
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if !isValidFilter(id) {
+				res.Errors[id] = &Error{Code: codeInvalidArgument, Message: id + " is invalid"}
+				continue
+			}
+			if field == "groups" && !allowsGroup(r.Context(), id) {
+				client, _ := ClientFromContext(r.Context())
+				res.Errors[id] = &Error{Code: codePermissionDenied, Message: fmt.Sprintf("client %s is not allowed to access group %s", client, id)}
+				continue
+			}
+			valid = append(valid, id)
+		}
+
+		for id, result := range lookup(r.Context(), valid) {
+			if result.Err != nil {
+				logger.Info("error in batch lookup", zap.Error(result.Err), zap.String(field, id))
+				code, message := lookupError(result.Err)
+				res.Errors[id] = &Error{Code: code, Message: message}
+				continue
+			}
+			list := result.List
+			if field == "users" {
+				list = allowedGroups(r.Context(), list)
+			}
+			res.Results[id] = nonNil(list)
+		}
+		logger.Info("batch lookup", zap.String("field", field), zap.Int("results", len(res.Results)), zap.Int("errors", len(res.Errors)))
+		writeJSON(w, http.StatusOK, res)
+	})
+}
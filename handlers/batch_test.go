@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/policy"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// batchLooker implements pkg.BatchGroupLooker over a staticLooker, the group nobody does not exist.
+type batchLooker struct {
+	*staticLooker
+	batches int
+}
+
+func (l *batchLooker) GetUsersInGroups(ctx context.Context, gids []string, concurrency int) map[string]*pkg.BatchResult {
+	l.batches++
+	return pkg.Batch(ctx, gids, concurrency, func(ctx context.Context, gid string) ([]string, error) {
+		if gid == "nobody" {
+			return nil, pkg.NewGroupLookerError(pkg.GroupLookerErrorNotFound).WithMessage("group nobody not found")
+		}
+		return l.members[gid], nil
+	})
+}
+
+func (l *batchLooker) GetGroupsOfUsers(ctx context.Context, uids []string, concurrency int) map[string]*pkg.BatchResult {
+	return nil
+}
+
+func (l *batchLooker) GetUsersInComputingGroups(ctx context.Context, gids []string, concurrency int) map[string]*pkg.BatchResult {
+	return nil
+}
+
+func (l *batchLooker) GetComputingGroupsOfUsers(ctx context.Context, uids []string, concurrency int) map[string]*pkg.BatchResult {
+	return nil
+}
+
+func postBatch(t *testing.T, h http.Handler, body string) (*httptest.ResponseRecorder, *batchResponse) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	res := &batchResponse{}
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec, res
+}
+
+func TestBatch(t *testing.T) {
+	looker := &staticLooker{groups: map[string][]string{"hugo": {"cernbox-admins", "it-dep"}}}
+
+	// the memory and bolt backends are looked up one by one
+	h := BatchUserGroups(zap.NewNop(), looker, 10, 2)
+	rec, res := postBatch(t, h, `{"users": ["hugo", "nogroups", "bad*uid", "hugo"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	expected := map[string][]string{"hugo": {"cernbox-admins", "it-dep"}, "nogroups": {}}
+	if !reflect.DeepEqual(res.Results, expected) {
+		t.Errorf("expected %v, got %v", expected, res.Results)
+	}
+	if e := res.Errors["bad*uid"]; len(res.Errors) != 1 || e == nil || e.Code != codeInvalidArgument {
+		t.Errorf("expected an error for the invalid uid, got %v", res.Errors)
+	}
+
+	// the looker's own batch is used when it has one, failures are reported per group
+	bl := &batchLooker{staticLooker: &staticLooker{members: map[string][]string{"cernbox-admins": {"hugo"}}}}
+	h = BatchUsersInGroup(zap.NewNop(), bl, 10, 2)
+	rec, res = postBatch(t, h, `{"groups": ["cernbox-admins", "nobody"]}`)
+	if rec.Code != http.StatusOK || bl.batches != 1 {
+		t.Fatalf("expected 200 from the batch lookup, got %d after %d batches", rec.Code, bl.batches)
+	}
+	if got := res.Results["cernbox-admins"]; len(got) != 1 || got[0] != "hugo" {
+		t.Errorf("unexpected members %v", got)
+	}
+	if e := res.Errors["nobody"]; e == nil || e.Code != codeNotFound || e.Message != "group nobody not found" {
+		t.Errorf("expected not found for nobody, got %+v", e)
+	}
+
+	if rec, _ := postBatch(t, h, `{"groups": ["a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"]}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a batch over the limit, got %d", rec.Code)
+	}
+	if rec, _ := postBatch(t, h, `{"users": ["hugo"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without groups, got %d", rec.Code)
+	}
+}
+
+func TestBatchPolicy(t *testing.T) {
+	policies, err := policy.New([]policy.Policy{{Client: "web", Routes: []string{policy.Membership}, Groups: []string{"cernbox-*"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	looker := &staticLooker{
+		members: map[string][]string{"cernbox-admins": {"hugo"}, "it-dep": {"hugo"}},
+		groups:  map[string][]string{"hugo": {"cernbox-admins", "it-dep"}},
+	}
+	post := func(h http.Handler, body string) (*httptest.ResponseRecorder, *batchResponse) {
+		h = Authorize(zap.NewNop(), policies, policy.Membership)(h)
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req.WithContext(WithClient(req.Context(), "web")))
+		res := &batchResponse{}
+		json.NewDecoder(rec.Body).Decode(res)
+		return rec, res
+	}
+
+	// the denied groups are reported, the allowed ones answered
+	rec, res := post(BatchUsersInGroup(zap.NewNop(), looker, 10, 2), `{"groups": ["cernbox-admins", "it-dep"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if got := res.Results["cernbox-admins"]; len(res.Results) != 1 || len(got) != 1 {
+		t.Errorf("expected the members of cernbox-admins only, got %v", res.Results)
+	}
+	if e := res.Errors["it-dep"]; e == nil || e.Code != codePermissionDenied || e.Message != "client web is not allowed to access group it-dep" {
+		t.Errorf("expected it-dep to be denied, got %+v", e)
+	}
+
+	// the groups of the users are filtered
+	_, res = post(BatchUserGroups(zap.NewNop(), looker, 10, 2), `{"users": ["hugo"]}`)
+	if got := res.Results["hugo"]; !reflect.DeepEqual(got, []string{"cernbox-admins"}) {
+		t.Errorf("expected the allowed groups of hugo, got %v", got)
+	}
+}
+
+func TestBatchBodyLimit(t *testing.T) {
+	looker := &staticLooker{}
+	h := LimitBody(zap.NewNop(), 2)(BatchUserGroups(zap.NewNop(), looker, 2, 2))
+	body := `{"users": ["` + strings.Repeat("a", 2*maxItemBytes+1024) + `"]}`
+
+	// announced by the client
+	rec, _ := postBatch(t, h, body)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a large body, got %d", rec.Code)
+	}
+
+	// found while reading it
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "too large") {
+		t.Errorf("expected 400 for a large chunked body, got %d %s", rec.Code, rec.Body.String())
+	}
+}
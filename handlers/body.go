@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// maxItemBytes is the room given to every group, user or filter of a request body,
+// far more than the 64 characters of a CN with its quotes and comma.
+const maxItemBytes = 256
+
+// LimitBody returns a middleware that stops reading the body of a request after the
+// room for maxItems groups, users or filters, so it goes before the audit and the
+// policies that read it too. Bodies announcing a larger size are answered 422 unread.
+func LimitBody(logger *zap.Logger, maxItems int) func(http.Handler) http.Handler {
+	max := int64(maxItems)*maxItemBytes + 1024
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > max {
+				logger.Warn("request body too large", zap.Int64("size", r.ContentLength), zap.Int64("max", max))
+				writeError(w, r, codeTooLarge, fmt.Sprintf("request body larger than %d bytes", max))
+				return
+			}
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, max)
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
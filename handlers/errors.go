@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Error is the body of every error response.
+type Error struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Codes of the error responses. The ones of the GroupLooker errors are their
+// pkg.GroupLookerErrorCode without the GROUPLOOKER_ERROR_ prefix.
+const (
+	codeNotFound         = "NOT_FOUND"
+	codeInvalidArgument  = "INVALID_ARGUMENT"
+	codeUnavailable      = "UNAVAILABLE"
+	codeTimeout          = "TIMEOUT"
+	codeLimitExceeded    = "LIMIT_EXCEEDED"
+	codeTooLarge         = "TOO_LARGE"
+	codeUnauthenticated  = "UNAUTHENTICATED"
+	codePermissionDenied = "PERMISSION_DENIED"
+	codeInternal         = "INTERNAL"
+)
+
+var codeStatus = map[string]int{
+	codeNotFound:         http.StatusNotFound,
+	codeInvalidArgument:  http.StatusBadRequest,
+	codeUnavailable:      http.StatusServiceUnavailable,
+	codeTimeout:          http.StatusGatewayTimeout,
+	codeLimitExceeded:    http.StatusTooManyRequests,
+	codeTooLarge:         http.StatusUnprocessableEntity,
+	codeUnauthenticated:  http.StatusUnauthorized,
+	codePermissionDenied: http.StatusForbidden,
+	codeInternal:         http.StatusInternalServerError,
+}
+
+// writeError answers with the status of code and an Error body.
+func writeError(w http.ResponseWriter, r *http.Request, code, message string) {
+	status, ok := codeStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, &Error{Code: code, Message: message, RequestID: RequestIDFromContext(r.Context())})
+}
+
+// writeLookupError answers the error of a GroupLooker. The message of other errors
+// is not sent to the client, it may reveal details of the backends, but it is recorded
+// in the span of the request. Unknown users and groups are answers, not errors.
+func writeLookupError(w http.ResponseWriter, r *http.Request, err error) {
+	if !errors.Is(err, pkg.ErrNotFound) {
+		trace.SpanFromContext(r.Context()).RecordError(err)
+	}
+	code, message := lookupError(err)
+	writeError(w, r, code, message)
+}
+
+// lookupError returns the code and the message answered for the error of a GroupLooker.
+func lookupError(err error) (code, message string) {
+	var gle pkg.GroupLookerError
+	if errors.As(err, &gle) {
+		code = strings.TrimPrefix(string(gle.Code), "GROUPLOOKER_ERROR_")
+		message = gle.Message
+		if message == "" {
+			message = strings.ToLower(strings.Replace(code, "_", " ", -1))
+		}
+		return code, message
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return codeTimeout, "lookup timed out"
+	}
+	return codeInternal, "internal error"
+}
+
+// NotFound answers the requests that match no route.
+func NotFound() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, codeNotFound, "no such route")
+	})
+}
+
+type requestIDKey struct{}
+
+var requestIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9._\-]{1,128}$`)
+
+// RequestID gives every request an ID, the one in its X-Request-Id header if it is
+// sane or a random one, returned in the X-Request-Id header of the response and in
+// the error responses.
+func RequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !requestIDRegexp.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFromContext returns the ID given by RequestID, empty if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteLookupError(t *testing.T) {
+	tests := []struct {
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{pkg.NewGroupLookerError(pkg.GroupLookerErrorNotFound), http.StatusNotFound, "NOT_FOUND", "not found"},
+		{pkg.NewGroupLookerError(pkg.GroupLookerErrorInvalidArgument).WithMessage("bad gid"), http.StatusBadRequest, "INVALID_ARGUMENT", "bad gid"},
+		{pkg.NewGroupLookerError(pkg.GroupLookerErrorUnavailable), http.StatusServiceUnavailable, "UNAVAILABLE", "unavailable"},
+		{pkg.NewGroupLookerError(pkg.GroupLookerErrorTimeout), http.StatusGatewayTimeout, "TIMEOUT", "timeout"},
+		{pkg.NewGroupLookerError(pkg.GroupLookerErrorLimitExceeded), http.StatusTooManyRequests, "LIMIT_EXCEEDED", "limit exceeded"},
+		{pkg.NewGroupLookerError(pkg.GroupLookerErrorTooLarge), http.StatusUnprocessableEntity, "TOO_LARGE", "too large"},
+		{pkg.NewGroupLookerError(pkg.GroupLookerErrorPermissionDenied).WithMessage("LDAP lookup not allowed").WithCause(errors.New("ldap: insufficient access")),
+			http.StatusForbidden, "PERMISSION_DENIED", "LDAP lookup not allowed"},
+		{fmt.Errorf("refresh: %w", pkg.NewGroupLookerError(pkg.GroupLookerErrorNotFound).WithMessage("no such LDAP entry")), http.StatusNotFound, "NOT_FOUND", "no such LDAP entry"},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, "TIMEOUT", "lookup timed out"},
+		{errors.New("ldap: connection refused to 10.0.0.1"), http.StatusInternalServerError, "INTERNAL", "internal error"},
+	}
+	for _, test := range tests {
+		var res *httptest.ResponseRecorder
+		RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res = httptest.NewRecorder()
+			writeLookupError(res, r, test.err)
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		if res.Code != test.status {
+			t.Errorf("%v: expected %d, got %d", test.err, test.status, res.Code)
+		}
+		if ct := res.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("%v: unexpected content type %q", test.err, ct)
+		}
+		e := &Error{}
+		if err := json.Unmarshal(res.Body.Bytes(), e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Code != test.code || e.Message != test.message || len(e.RequestID) != 32 {
+			t.Errorf("%v: unexpected body %s", test.err, res.Body.String())
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, codeNotFound, "no such route")
+	}))
+
+	for header, keep := range map[string]bool{"abc-123.x_y": true, "": false, "bad id\n": false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-Id", header)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		id := rec.Header().Get("X-Request-Id")
+		if keep && id != header || !keep && (id == header || len(id) != 32) {
+			t.Errorf("%q: unexpected request id %q", header, id)
+		}
+		e := &Error{}
+		json.Unmarshal(rec.Body.Bytes(), e)
+		if e.RequestID != id {
+			t.Errorf("%q: expected request id %q in the body, got %q", header, id, e.RequestID)
+		}
+	}
+}
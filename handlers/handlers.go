@@ -1,33 +1,20 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/cachestats"
+	"github.com/cernbox/cboxgroupd/pkg/metrics"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
-	"io/ioutil"
 	"net/http"
 	"regexp"
-	"strings"
-	"sync"
 )
 
 var searchTermRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.\-:\s]*$`)
 
-func CheckSharedSecret(logger *zap.Logger, secret string, handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// The secret is passed in the header: Authorization: Bearer mysecret
-		h := r.Header.Get("Authorization")
-		secret := "bearer " + secret
-		if secret != strings.ToLower(h) {
-			logger.Warn("wrong secret")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		handler.ServeHTTP(w, r)
-	})
-}
-
 func isValidFilter(s string) bool {
 	if s == "" {
 		return false
@@ -36,24 +23,44 @@ func isValidFilter(s string) bool {
 	return searchTermRegexp.MatchString(s)
 }
 
+// writeJSON answers with status and v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// nonNil returns list, or an empty list if it is nil, so that it is encoded as [] and not null.
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
 func Search(logger *zap.Logger, groupLooker pkg.GroupLooker) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		filter := mux.Vars(r)["filter"]
 		if !isValidFilter(filter) {
 			logger.Error("filter is invalid")
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, codeInvalidArgument, "filter is invalid")
 			return
 		}
 
 		entries, err := groupLooker.Search(r.Context(), filter, true)
 		if err != nil {
 			logger.Info("error getting entries", zap.Error(err), zap.String("filter", filter))
-			w.WriteHeader(http.StatusInternalServerError)
+			writeLookupError(w, r, err)
 			return
 		}
+		entries = allowedEntries(r.Context(), entries)
+		metrics.MembershipListSize.WithLabelValues("search").Observe(float64(len(entries)))
 		logger.Info("entries found", zap.Int("numentries", len(entries)), zap.String("filter", filter))
-		json.NewEncoder(w).Encode(entries)
+		if entries == nil {
+			entries = []*pkg.SearchEntry{}
+		}
+		writeJSON(w, http.StatusOK, entries)
 	})
 }
 
@@ -61,26 +68,25 @@ func UsersInGroup(logger *zap.Logger, groupLooker pkg.GroupLooker) http.Handler
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		gid := mux.Vars(r)["gid"]
 		if !isValidFilter(gid) {
-			logger.Error("gid is empty")
-			w.WriteHeader(http.StatusBadRequest)
+			logger.Error("gid is invalid")
+			writeError(w, r, codeInvalidArgument, "gid is invalid")
 			return
 		}
 
 		uids, err := groupLooker.GetUsersInGroup(r.Context(), gid, true)
 		if err != nil {
-			if gle, ok := err.(pkg.GroupLookerError); ok {
-				if gle.Code == pkg.GroupLookerErrorNotFound {
-					logger.Warn("group not found", zap.String("gid", gid))
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
+			if errors.Is(err, pkg.ErrNotFound) {
+				logger.Warn("group not found", zap.String("gid", gid))
+				writeError(w, r, codeNotFound, "group "+gid+" not found")
+				return
 			}
 			logger.Info("error getting users", zap.Error(err), zap.String("gid", gid))
-			w.WriteHeader(http.StatusInternalServerError)
+			writeLookupError(w, r, err)
 			return
 		}
+		metrics.MembershipListSize.WithLabelValues("usersingroup").Observe(float64(len(uids)))
 		logger.Info("users found", zap.Int("numusers", len(uids)), zap.String("gid", gid))
-		json.NewEncoder(w).Encode(uids)
+		writeJSON(w, http.StatusOK, nonNil(uids))
 	})
 }
 
@@ -89,25 +95,24 @@ func UsersInComputingGroup(logger *zap.Logger, groupLooker pkg.GroupLooker) http
 		gid := mux.Vars(r)["gid"]
 		if !isValidFilter(gid) {
 			logger.Error("gid is invalid")
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, codeInvalidArgument, "gid is invalid")
 			return
 		}
 
 		uids, err := groupLooker.GetUsersInComputingGroup(r.Context(), gid, true)
 		if err != nil {
-			if gle, ok := err.(pkg.GroupLookerError); ok {
-				if gle.Code == pkg.GroupLookerErrorNotFound {
-					logger.Warn("computing group not found", zap.String("gid", gid))
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
+			if errors.Is(err, pkg.ErrNotFound) {
+				logger.Warn("computing group not found", zap.String("gid", gid))
+				writeError(w, r, codeNotFound, "computing group "+gid+" not found")
+				return
 			}
 			logger.Info("error getting users", zap.Error(err), zap.String("gid", gid))
-			w.WriteHeader(http.StatusInternalServerError)
+			writeLookupError(w, r, err)
 			return
 		}
+		metrics.MembershipListSize.WithLabelValues("usersincomputinggroup").Observe(float64(len(uids)))
 		logger.Info("users found", zap.Int("numusers", len(uids)), zap.String("gid", gid))
-		json.NewEncoder(w).Encode(uids)
+		writeJSON(w, http.StatusOK, nonNil(uids))
 	})
 }
 
@@ -116,25 +121,25 @@ func UserGroups(logger *zap.Logger, groupLooker pkg.GroupLooker) http.Handler {
 		uid := mux.Vars(r)["uid"]
 		if !isValidFilter(uid) {
 			logger.Error("uid is invalid")
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, codeInvalidArgument, "uid is invalid")
 			return
 		}
 
 		gids, err := groupLooker.GetUserGroups(r.Context(), uid, true)
 		if err != nil {
-			if gle, ok := err.(pkg.GroupLookerError); ok {
-				if gle.Code == pkg.GroupLookerErrorNotFound {
-					logger.Warn("user not found", zap.String("uid", uid))
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
+			if errors.Is(err, pkg.ErrNotFound) {
+				logger.Warn("user not found", zap.String("uid", uid))
+				writeError(w, r, codeNotFound, "user "+uid+" not found")
+				return
 			}
 			logger.Info("error getting users", zap.Error(err), zap.String("uid", uid))
-			w.WriteHeader(http.StatusInternalServerError)
+			writeLookupError(w, r, err)
 			return
 		}
+		gids = allowedGroups(r.Context(), gids)
+		metrics.MembershipListSize.WithLabelValues("usergroups").Observe(float64(len(gids)))
 		logger.Info("groups found", zap.Int("numgroups", len(gids)), zap.String("uid", uid))
-		json.NewEncoder(w).Encode(gids)
+		writeJSON(w, http.StatusOK, nonNil(gids))
 	})
 }
 
@@ -143,25 +148,67 @@ func UserComputingGroups(logger *zap.Logger, groupLooker pkg.GroupLooker) http.H
 		uid := mux.Vars(r)["uid"]
 		if !isValidFilter(uid) {
 			logger.Error("uid is invalid")
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, codeInvalidArgument, "uid is invalid")
 			return
 		}
 
 		gids, err := groupLooker.GetUserComputingGroups(r.Context(), uid, true)
 		if err != nil {
-			if gle, ok := err.(pkg.GroupLookerError); ok {
-				if gle.Code == pkg.GroupLookerErrorNotFound {
-					logger.Warn("user not found", zap.String("uid", uid))
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
+			if errors.Is(err, pkg.ErrNotFound) {
+				logger.Warn("user not found", zap.String("uid", uid))
+				writeError(w, r, codeNotFound, "user "+uid+" not found")
+				return
 			}
 			logger.Info("error getting users", zap.Error(err), zap.String("uid", uid))
-			w.WriteHeader(http.StatusInternalServerError)
+			writeLookupError(w, r, err)
 			return
 		}
+		gids = allowedGroups(r.Context(), gids)
+		metrics.MembershipListSize.WithLabelValues("usercomputinggroups").Observe(float64(len(gids)))
 		logger.Info("unix groups found", zap.Int("numgroups", len(gids)), zap.String("uid", uid))
-		json.NewEncoder(w).Encode(gids)
+		writeJSON(w, http.StatusOK, nonNil(gids))
+	})
+}
+
+// membership is the answer of the ismember routes.
+type membership struct {
+	UID    string `json:"uid"`
+	GID    string `json:"gid"`
+	Member bool   `json:"member"`
+}
+
+// IsMember answers whether a user is a member of an e-group, directly or through nested groups.
+func IsMember(logger *zap.Logger, groupLooker pkg.GroupLooker) http.Handler {
+	return isMember(logger, "e-group", groupLooker.IsUserInGroup)
+}
+
+// IsMemberOfComputingGroup answers whether a user is a member of a computing group.
+func IsMemberOfComputingGroup(logger *zap.Logger, groupLooker pkg.GroupLooker) http.Handler {
+	return isMember(logger, "computing group", groupLooker.IsUserInComputingGroup)
+}
+
+func isMember(logger *zap.Logger, kind string, lookup func(ctx context.Context, uid, gid string, cached bool) (bool, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid, gid := mux.Vars(r)["uid"], mux.Vars(r)["gid"]
+		if !isValidFilter(uid) {
+			logger.Error("uid is invalid")
+			writeError(w, r, codeInvalidArgument, "uid is invalid")
+			return
+		}
+		if !isValidFilter(gid) {
+			logger.Error("gid is invalid")
+			writeError(w, r, codeInvalidArgument, "gid is invalid")
+			return
+		}
+
+		member, err := lookup(r.Context(), uid, gid, true)
+		if err != nil {
+			logger.Info("error checking membership", zap.Error(err), zap.String("uid", uid), zap.String("gid", gid), zap.String("kind", kind))
+			writeLookupError(w, r, err)
+			return
+		}
+		logger.Info("membership checked", zap.String("uid", uid), zap.String("gid", gid), zap.String("kind", kind), zap.Bool("member", member))
+		writeJSON(w, http.StatusOK, &membership{UID: uid, GID: gid, Member: member})
 	})
 }
 
@@ -170,14 +217,14 @@ func UserGroupsTTL(logger *zap.Logger, groupLooker pkg.GroupLooker) http.Handler
 		uid := mux.Vars(r)["uid"]
 		if !isValidFilter(uid) {
 			logger.Error("uid is invalid")
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, codeInvalidArgument, "uid is invalid")
 			return
 		}
 
 		ttl, err := groupLooker.GetTTLForUser(r.Context(), uid)
 		if err != nil {
 			logger.Info("error getting ttl for user", zap.Error(err), zap.String("uid", uid))
-			w.WriteHeader(http.StatusInternalServerError)
+			writeLookupError(w, r, err)
 			return
 		}
 
@@ -186,7 +233,7 @@ func UserGroupsTTL(logger *zap.Logger, groupLooker pkg.GroupLooker) http.Handler
 			TTL float64 `json:"ttl"`
 		}{uid, ttl.Seconds()}
 		logger.Info("ttl retrieved", zap.String("uid", uid), zap.Float64("ttl", res.TTL))
-		json.NewEncoder(w).Encode(res)
+		writeJSON(w, http.StatusOK, res)
 	})
 }
 
@@ -195,14 +242,14 @@ func UserComputingGroupsTTL(logger *zap.Logger, groupLooker pkg.GroupLooker) htt
 		uid := mux.Vars(r)["uid"]
 		if !isValidFilter(uid) {
 			logger.Error("uid is invalid")
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, codeInvalidArgument, "uid is invalid")
 			return
 		}
 
 		ttl, err := groupLooker.GetTTLForComputingUser(r.Context(), uid)
 		if err != nil {
 			logger.Info("error getting ttl for computing user", zap.Error(err), zap.String("uid", uid))
-			w.WriteHeader(http.StatusInternalServerError)
+			writeLookupError(w, r, err)
 			return
 		}
 
@@ -211,7 +258,7 @@ func UserComputingGroupsTTL(logger *zap.Logger, groupLooker pkg.GroupLooker) htt
 			TTL float64 `json:"ttl"`
 		}{uid, ttl.Seconds()}
 		logger.Info("ttl retrieved", zap.String("uid", uid), zap.Float64("ttl", res.TTL))
-		json.NewEncoder(w).Encode(res)
+		writeJSON(w, http.StatusOK, res)
 	})
 }
 
@@ -220,14 +267,14 @@ func UsersInGroupTTL(logger *zap.Logger, groupLooker pkg.GroupLooker) http.Handl
 		gid := mux.Vars(r)["gid"]
 		if !isValidFilter(gid) {
 			logger.Error("gid is invalid")
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, codeInvalidArgument, "gid is invalid")
 			return
 		}
 
 		ttl, err := groupLooker.GetTTLForGroup(r.Context(), gid)
 		if err != nil {
 			logger.Info("error getting ttl for group", zap.Error(err), zap.String("gid", gid))
-			w.WriteHeader(http.StatusInternalServerError)
+			writeLookupError(w, r, err)
 			return
 		}
 
@@ -236,7 +283,7 @@ func UsersInGroupTTL(logger *zap.Logger, groupLooker pkg.GroupLooker) http.Handl
 			TTL float64 `json:"ttl"`
 		}{gid, ttl.Seconds()}
 		logger.Info("ttl retrieved", zap.String("gid", gid), zap.Float64("ttl", res.TTL))
-		json.NewEncoder(w).Encode(res)
+		writeJSON(w, http.StatusOK, res)
 	})
 }
 
@@ -245,14 +292,14 @@ func UsersInComputingGroupTTL(logger *zap.Logger, groupLooker pkg.GroupLooker) h
 		gid := mux.Vars(r)["gid"]
 		if !isValidFilter(gid) {
 			logger.Error("gid is invalid")
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, codeInvalidArgument, "gid is invalid")
 			return
 		}
 
 		ttl, err := groupLooker.GetTTLForComputingGroup(r.Context(), gid)
 		if err != nil {
 			logger.Info("error getting ttl for computing group", zap.Error(err), zap.String("gid", gid))
-			w.WriteHeader(http.StatusInternalServerError)
+			writeLookupError(w, r, err)
 			return
 		}
 
@@ -261,106 +308,22 @@ func UsersInComputingGroupTTL(logger *zap.Logger, groupLooker pkg.GroupLooker) h
 			TTL float64 `json:"ttl"`
 		}{gid, ttl.Seconds()}
 		logger.Info("ttl retrieved", zap.String("gid", gid), zap.Float64("ttl", res.TTL))
-		json.NewEncoder(w).Encode(res)
+		writeJSON(w, http.StatusOK, res)
 	})
 }
 
-// UpdateUsersInGroups allows to trigger a refresh of users belonfing to a group
-func UpdateUsersInGroup(logger *zap.Logger, groupLooker pkg.GroupLooker, maxConcurrency int) http.Handler {
+// CacheStats returns the hit/miss counters of the cache layer
+func CacheStats(logger *zap.Logger, stats *cachestats.Stats) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		type request struct {
-			Groups []string `json:"groups"`
-		}
-		data, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			logger.Error(err.Error())
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		req := &request{}
-		err = json.Unmarshal(data, req)
-		if err != nil {
-			logger.Error(err.Error())
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		go func() {
-			var throttle = make(chan int, maxConcurrency)
-			var wg sync.WaitGroup
-			for _, gid := range req.Groups {
-				if gid != "" {
-					throttle <- 1
-					wg.Add(1)
-					go func(wg *sync.WaitGroup, throttle chan int, gid string) {
-						defer wg.Done()
-						defer func() { <-throttle }()
-						uids, err := groupLooker.GetUsersInGroup(r.Context(), gid, false)
-						if err != nil {
-							if gle, ok := err.(pkg.GroupLookerError); ok {
-								if gle.Code == pkg.GroupLookerErrorNotFound {
-									logger.Warn("async: group not found", zap.String("gid", gid))
-									return
-								}
-							}
-							logger.Info("async: error getting users", zap.Error(err), zap.String("gid", gid))
-						}
-						logger.Info("async: users found", zap.Int("numusers", len(uids)), zap.String("gid", gid))
-					}(&wg, throttle, gid)
-				}
-			}
-			wg.Wait()
-		}()
-		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, http.StatusOK, stats.Snapshot())
 	})
 }
 
-// UpdateUserGroups allows to trigger a refresh of groups belonfing to an user
-func UpdateUserGroups(logger *zap.Logger, groupLooker pkg.GroupLooker, maxConcurrency int) http.Handler {
+// ResetCacheStats sets the counters of the cache layer to zero and returns their values before the reset
+func ResetCacheStats(logger *zap.Logger, stats *cachestats.Stats) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		type request struct {
-			Users []string `json:"users"`
-		}
-		data, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			logger.Error(err.Error())
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		req := &request{}
-		err = json.Unmarshal(data, req)
-		if err != nil {
-			logger.Error(err.Error())
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		go func() {
-			var throttle = make(chan int, maxConcurrency)
-			var wg sync.WaitGroup
-			for _, uid := range req.Users {
-				if uid != "" {
-					throttle <- 1
-					wg.Add(1)
-					go func(wg *sync.WaitGroup, throttle chan int, uid string) {
-						defer wg.Done()
-						defer func() { <-throttle }()
-						gids, err := groupLooker.GetUserGroups(r.Context(), uid, false)
-						if err != nil {
-							if gle, ok := err.(pkg.GroupLookerError); ok {
-								if gle.Code == pkg.GroupLookerErrorNotFound {
-									logger.Warn("async: user not found", zap.String("uid", uid))
-								}
-							}
-							logger.Info("async: error getting groups", zap.Error(err), zap.String("uid", uid))
-							return
-						}
-						logger.Info("async: groups found", zap.Int("numgroups", len(gids)), zap.String("uid", uid))
-					}(&wg, throttle, uid)
-				}
-			}
-			wg.Wait()
-		}()
-		w.WriteHeader(http.StatusAccepted)
+		snap := stats.Reset()
+		logger.Info("cache stats reset")
+		writeJSON(w, http.StatusOK, snap)
 	})
 }
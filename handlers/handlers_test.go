@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// staticLooker answers from its maps, unknown keys give nil lists like the backends
+// do for empty results.
+type staticLooker struct {
+	pkg.GroupLooker
+	members map[string][]string
+	groups  map[string][]string
+	entries map[string][]*pkg.SearchEntry
+	ttl     time.Duration
+}
+
+func (l *staticLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	return l.members[gid], nil
+}
+
+func (l *staticLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	return l.members[gid], nil
+}
+
+func (l *staticLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	return l.groups[uid], nil
+}
+
+func (l *staticLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	return l.groups[uid], nil
+}
+
+func (l *staticLooker) Search(ctx context.Context, filter string, cached bool) ([]*pkg.SearchEntry, error) {
+	return l.entries[filter], nil
+}
+
+func (l *staticLooker) IsUserInGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	return pkg.Contains(l.members[gid], uid), nil
+}
+
+func (l *staticLooker) IsUserInComputingGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	return pkg.Contains(l.members[gid], uid), nil
+}
+
+func (l *staticLooker) GetTTLForUser(ctx context.Context, uid string) (time.Duration, error) {
+	return l.ttl, nil
+}
+
+func (l *staticLooker) GetTTLForGroup(ctx context.Context, gid string) (time.Duration, error) {
+	return l.ttl, nil
+}
+
+func (l *staticLooker) GetTTLForComputingUser(ctx context.Context, uid string) (time.Duration, error) {
+	return l.ttl, nil
+}
+
+func (l *staticLooker) GetTTLForComputingGroup(ctx context.Context, gid string) (time.Duration, error) {
+	return l.ttl, nil
+}
+
+func TestResponses(t *testing.T) {
+	looker := &staticLooker{
+		members: map[string][]string{"cernbox-admins": {"hugo", "labkode"}},
+		groups:  map[string][]string{"hugo": {"cernbox-admins", "it-dep"}},
+		entries: map[string][]*pkg.SearchEntry{
+			"hugo": {{DN: "CN=hugo,OU=Users,OU=Organic Units,DC=cern,DC=ch", CN: "hugo", DisplayName: "Hugo Gonzalez", Mail: "hugo@cern.ch", AccountType: pkg.LDAPAccountTypePrimary}},
+		},
+		ttl: 90 * time.Second,
+	}
+	logger := zap.NewNop()
+
+	tests := []struct {
+		golden  string
+		handler http.Handler
+		vars    map[string]string
+	}{
+		{"usersingroup.golden", UsersInGroup(logger, looker), map[string]string{"gid": "cernbox-admins"}},
+		{"usersingroup_empty.golden", UsersInGroup(logger, looker), map[string]string{"gid": "empty-group"}},
+		{"usersincomputinggroup.golden", UsersInComputingGroup(logger, looker), map[string]string{"gid": "cernbox-admins"}},
+		{"usersincomputinggroup_empty.golden", UsersInComputingGroup(logger, looker), map[string]string{"gid": "empty-group"}},
+		{"usergroups.golden", UserGroups(logger, looker), map[string]string{"uid": "hugo"}},
+		{"usergroups_empty.golden", UserGroups(logger, looker), map[string]string{"uid": "nogroups"}},
+		{"usercomputinggroups.golden", UserComputingGroups(logger, looker), map[string]string{"uid": "hugo"}},
+		{"usercomputinggroups_empty.golden", UserComputingGroups(logger, looker), map[string]string{"uid": "nogroups"}},
+		{"search.golden", Search(logger, looker), map[string]string{"filter": "hugo"}},
+		{"search_empty.golden", Search(logger, looker), map[string]string{"filter": "nobody"}},
+		{"ismember.golden", IsMember(logger, looker), map[string]string{"uid": "hugo", "gid": "cernbox-admins"}},
+		{"ismember_not.golden", IsMember(logger, looker), map[string]string{"uid": "nogroups", "gid": "cernbox-admins"}},
+		{"ismemberofcomputinggroup.golden", IsMemberOfComputingGroup(logger, looker), map[string]string{"uid": "hugo", "gid": "cernbox-admins"}},
+		{"usergroupsttl.golden", UserGroupsTTL(logger, looker), map[string]string{"uid": "hugo"}},
+		{"usercomputinggroupsttl.golden", UserComputingGroupsTTL(logger, looker), map[string]string{"uid": "hugo"}},
+		{"usersingroupttl.golden", UsersInGroupTTL(logger, looker), map[string]string{"gid": "cernbox-admins"}},
+		{"usersincomputinggroupttl.golden", UsersInComputingGroupTTL(logger, looker), map[string]string{"gid": "cernbox-admins"}},
+	}
+	for _, test := range tests {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), test.vars)
+		rec := httptest.NewRecorder()
+		test.handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", test.golden, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("%s: unexpected content type %q", test.golden, ct)
+		}
+
+		golden := filepath.Join("testdata", test.golden)
+		if *update {
+			if err := ioutil.WriteFile(golden, rec.Body.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), want) {
+			t.Errorf("%s: expected %s, got %s", test.golden, want, rec.Body.Bytes())
+		}
+	}
+}
+
+// missingLooker knows no user and no group, like LDAP answers for unknown entries.
+type missingLooker struct {
+	pkg.GroupLooker
+}
+
+func (l missingLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	return nil, fmt.Errorf("lookup: %w", pkg.ErrNotFound)
+}
+
+func (l missingLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	return nil, fmt.Errorf("lookup: %w", pkg.ErrNotFound)
+}
+
+func (l missingLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	return nil, fmt.Errorf("lookup: %w", pkg.ErrNotFound)
+}
+
+func (l missingLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	return nil, fmt.Errorf("lookup: %w", pkg.ErrNotFound)
+}
+
+func TestNotFound(t *testing.T) {
+	logger := zap.NewNop()
+	tests := []struct {
+		handler http.Handler
+		vars    map[string]string
+		message string
+	}{
+		{UsersInGroup(logger, missingLooker{}), map[string]string{"gid": "nogroup"}, "group nogroup not found"},
+		{UsersInComputingGroup(logger, missingLooker{}), map[string]string{"gid": "nogroup"}, "computing group nogroup not found"},
+		{UserGroups(logger, missingLooker{}), map[string]string{"uid": "nobody"}, "user nobody not found"},
+		{UserComputingGroups(logger, missingLooker{}), map[string]string{"uid": "nobody"}, "user nobody not found"},
+	}
+	for _, test := range tests {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), test.vars)
+		rec := httptest.NewRecorder()
+		test.handler.ServeHTTP(rec, req)
+
+		var body Error
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusNotFound || body.Code != codeNotFound || body.Message != test.message {
+			t.Errorf("%s: expected 404 %q, got %d %+v", test.message, test.message, rec.Code, body)
+		}
+	}
+}
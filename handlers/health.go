@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Readiness tells whether the server accepts traffic, it turns false when the server starts
+// draining at shutdown so the load balancers stop sending requests to it.
+type Readiness struct {
+	draining int32
+}
+
+func (r *Readiness) SetDraining() {
+	atomic.StoreInt32(&r.draining, 1)
+}
+
+func (r *Readiness) Draining() bool {
+	return atomic.LoadInt32(&r.draining) == 1
+}
+
+// Check is a dependency probed by Readyz.
+type Check struct {
+	Name   string
+	Pinger pkg.Pinger
+}
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type readyResponse struct {
+	Status string                  `json:"status"`
+	Checks map[string]*checkResult `json:"checks"`
+}
+
+// Healthz answers 200 as long as the process is able to serve requests.
+func Healthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+// Readyz probes all the dependencies in parallel, each within timeout, and answers 200
+// if all of them are reachable, else 503. It also answers 503 while draining.
+func Readyz(logger *zap.Logger, readiness *Readiness, checks []Check, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		res := &readyResponse{Status: "ok", Checks: map[string]*checkResult{}}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, check := range checks {
+			wg.Add(1)
+			go func(check Check) {
+				defer wg.Done()
+				start := time.Now()
+				err := check.Pinger.Ping(ctx)
+				result := &checkResult{Status: "ok", LatencyMS: float64(time.Since(start)) / float64(time.Millisecond)}
+				if err != nil {
+					logger.Warn("dependency not ready", zap.String("dependency", check.Name), zap.Error(err))
+					result.Status = "error"
+					result.Error = err.Error()
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				res.Checks[check.Name] = result
+				if err != nil {
+					res.Status = "unavailable"
+				}
+			}(check)
+		}
+		wg.Wait()
+
+		if readiness.Draining() {
+			res.Status = "draining"
+		}
+		status := http.StatusOK
+		if res.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, res)
+	})
+}
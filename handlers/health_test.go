@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type pingerFunc func(ctx context.Context) error
+
+func (f pingerFunc) Ping(ctx context.Context) error {
+	return f(ctx)
+}
+
+func TestReadyz(t *testing.T) {
+	var redisErr error
+	readiness := &Readiness{}
+	checks := []Check{
+		{Name: "ldap", Pinger: pingerFunc(func(ctx context.Context) error { return nil })},
+		{Name: "redis", Pinger: pingerFunc(func(ctx context.Context) error { return redisErr })},
+	}
+	h := Readyz(zap.NewNop(), readiness, checks, time.Second)
+
+	get := func() (int, *readyResponse) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		res := &readyResponse{}
+		if err := json.NewDecoder(rec.Body).Decode(res); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, res
+	}
+
+	if code, res := get(); code != http.StatusOK || res.Status != "ok" || len(res.Checks) != 2 {
+		t.Errorf("expected ready, got %d %+v", code, res)
+	}
+
+	redisErr = errors.New("connection refused")
+	code, res := get()
+	if code != http.StatusServiceUnavailable || res.Status != "unavailable" {
+		t.Errorf("expected unavailable, got %d %+v", code, res)
+	}
+	if c := res.Checks["redis"]; c.Status != "error" || c.Error != "connection refused" {
+		t.Errorf("expected redis error, got %+v", c)
+	}
+
+	redisErr = nil
+	readiness.SetDraining()
+	if code, res := get(); code != http.StatusServiceUnavailable || res.Status != "draining" {
+		t.Errorf("expected draining, got %d %+v", code, res)
+	}
+}
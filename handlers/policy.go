@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/policy"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+)
+
+type policyKey struct{}
+
+// Authorize returns a middleware that checks the policy of the authenticated client
+// for the routes of family. Requests naming a group, in the path or in the groups of
+// an update, are only allowed for the groups matching the policy. The groups of the
+// batch membership routes are checked one by one by the handler, see allowsGroup.
+// Denied requests are answered 403 with the reason. Clients without a policy, their own
+// or the one of policy.AnyClient, are let through: with a JWT verifier configured that
+// includes any subject the identity provider signs a token for.
+func Authorize(logger *zap.Logger, policies *policy.Policies, family string) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _ := ClientFromContext(r.Context())
+			p := policies.Get(client)
+			if p == nil {
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			if !p.AllowsRoute(family) {
+				deny(w, r, logger, client, fmt.Sprintf("client %s is not allowed to use the %s routes", client, family))
+				return
+			}
+
+			gids, err := requestGroups(r, family)
+			if err != nil {
+				logger.Error(err.Error())
+				writeError(w, r, codeInvalidArgument, "invalid request body")
+				return
+			}
+			for _, gid := range gids {
+				if !p.AllowsGroup(gid) {
+					deny(w, r, logger, client, fmt.Sprintf("client %s is not allowed to access group %s", client, gid))
+					return
+				}
+			}
+
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), policyKey{}, p)))
+		})
+	}
+}
+
+func deny(w http.ResponseWriter, r *http.Request, logger *zap.Logger, client, reason string) {
+	logger.Warn("request denied by policy", zap.String("client", client), zap.String("reason", reason))
+	writeError(w, r, codePermissionDenied, reason)
+}
+
+// requestGroups returns the group of the path and the groups of an update request.
+// The body is left in place for the handler.
+func requestGroups(r *http.Request, family string) ([]string, error) {
+	var gids []string
+	if gid, ok := mux.Vars(r)["gid"]; ok {
+		gids = append(gids, gid)
+	}
+	if r.Method != http.MethodPost || family != policy.Update {
+		return gids, nil
+	}
+
+	req, err := peekUpdate(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(gids, req.Groups...), nil
+}
+
+// updateRequest has the fields of the bodies of all the update routes.
+type updateRequest struct {
+	Groups  []string `json:"groups"`
+	Users   []string `json:"users"`
+	Filters []string `json:"filters"`
+}
+
+// peekUpdate decodes the body of an update request and leaves it in place for the handler.
+// Invalid bodies give an empty request, they are answered by the handler.
+func peekUpdate(r *http.Request) (*updateRequest, error) {
+	req := &updateRequest{}
+	if r.Body == nil {
+		return req, nil
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if err := json.Unmarshal(data, req); err != nil {
+		return &updateRequest{}, nil
+	}
+	return req, nil
+}
+
+// allowsGroup tells whether the policy of the client allows the group gid.
+func allowsGroup(ctx context.Context, gid string) bool {
+	p, ok := ctx.Value(policyKey{}).(*policy.Policy)
+	return !ok || p.AllowsGroup(gid)
+}
+
+// allowedGroups removes from gids the groups the policy of the client does not allow.
+func allowedGroups(ctx context.Context, gids []string) []string {
+	p, ok := ctx.Value(policyKey{}).(*policy.Policy)
+	if !ok || len(p.Groups) == 0 {
+		return gids
+	}
+	var allowed []string
+	for _, gid := range gids {
+		if p.AllowsGroup(gid) {
+			allowed = append(allowed, gid)
+		}
+	}
+	return allowed
+}
+
+// allowedEntries removes from entries the e-groups and computing groups the policy of
+// the client does not allow, the users are kept.
+func allowedEntries(ctx context.Context, entries []*pkg.SearchEntry) []*pkg.SearchEntry {
+	p, ok := ctx.Value(policyKey{}).(*policy.Policy)
+	if !ok || len(p.Groups) == 0 {
+		return entries
+	}
+	var allowed []*pkg.SearchEntry
+	for _, e := range entries {
+		isGroup := e.AccountType == pkg.LDAPAccountTypeEGroup || e.AccountType == pkg.LDAPAccountTypeUnixGroup
+		if !isGroup || p.AllowsGroup(e.CN) {
+			allowed = append(allowed, e)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/policy"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	policies, err := policy.New([]policy.Policy{{Client: "web", Routes: []string{policy.Membership, policy.Update}, Groups: []string{"cernbox-*"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		json.NewEncoder(w).Encode(allowedGroups(r.Context(), []string{"cernbox-admins", "it-dep"}))
+	})
+
+	tests := []struct {
+		name   string
+		client string
+		family string
+		method string
+		gid    string
+		body   string
+		code   int
+		reply  string
+	}{
+		{"unrestricted client", "sync", policy.Admin, "GET", "it-dep", "", http.StatusOK, `["cernbox-admins","it-dep"]`},
+		{"route not allowed", "web", policy.Search, "GET", "", "", http.StatusForbidden, `{"code":"PERMISSION_DENIED","message":"client web is not allowed to use the search routes"}`},
+		{"group allowed", "web", policy.Membership, "GET", "cernbox-admins", "", http.StatusOK, `["cernbox-admins"]`},
+		{"group not allowed", "web", policy.Membership, "GET", "it-dep", "", http.StatusForbidden, `{"code":"PERMISSION_DENIED","message":"client web is not allowed to access group it-dep"}`},
+		{"update groups allowed", "web", policy.Update, "POST", "", `{"groups":["cernbox-a","cernbox-b"]}`, http.StatusOK, `["cernbox-admins"]`},
+		{"update group not allowed", "web", policy.Update, "POST", "", `{"groups":["cernbox-a","it-dep"]}`, http.StatusForbidden, `{"code":"PERMISSION_DENIED","message":"client web is not allowed to access group it-dep"}`},
+		{"update users", "web", policy.Update, "POST", "", `{"users":["hugo"]}`, http.StatusOK, `["cernbox-admins"]`},
+	}
+	for _, test := range tests {
+		body = ""
+		h := Authorize(zap.NewNop(), policies, test.family)(next)
+		req := httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+		if test.gid != "" {
+			req = mux.SetURLVars(req, map[string]string{"gid": test.gid})
+		}
+		req = req.WithContext(WithClient(req.Context(), test.client))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, rec.Code)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != test.reply {
+			t.Errorf("%s: expected %q, got %q", test.name, test.reply, got)
+		}
+		if rec.Code == http.StatusOK && body != test.body {
+			t.Errorf("%s: handler read body %q", test.name, body)
+		}
+	}
+}
+
+func TestSearchFilteredByPolicy(t *testing.T) {
+	policies, err := policy.New([]policy.Policy{{Client: "web", Routes: []string{policy.Search}, Groups: []string{"cernbox-*"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	looker := &staticLooker{entries: map[string][]*pkg.SearchEntry{"a:cern": {
+		{CN: "cernbox-admins", AccountType: pkg.LDAPAccountTypeEGroup},
+		{CN: "cern-staff", AccountType: pkg.LDAPAccountTypeEGroup},
+		{CN: "cern-zp", AccountType: pkg.LDAPAccountTypeUnixGroup},
+		{CN: "cernuser", AccountType: pkg.LDAPAccountTypePrimary},
+	}}}
+	h := Authorize(zap.NewNop(), policies, policy.Search)(Search(zap.NewNop(), looker))
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"filter": "a:cern"})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req.WithContext(WithClient(req.Context(), "web")))
+	var entries []*pkg.SearchEntry
+	if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	var cns []string
+	for _, e := range entries {
+		cns = append(cns, e.CN)
+	}
+	if strings.Join(cns, ",") != "cernbox-admins,cernuser" {
+		t.Errorf("expected the allowed group and the user, got %v", cns)
+	}
+}
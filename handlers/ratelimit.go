@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"github.com/cernbox/cboxgroupd/pkg/metrics"
+	"github.com/cernbox/cboxgroupd/pkg/ratelimit"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimit returns a middleware that applies the rate limit of the authenticated client
+// on the routes of family. Limited requests carry X-RateLimit-Limit, X-RateLimit-Remaining
+// and X-RateLimit-Reset, the seconds until the limit is fully available again.
+// Requests over the limit are answered 429 with Retry-After.
+// If the limit cannot be checked the request is allowed.
+func RateLimit(logger *zap.Logger, limiter *ratelimit.Limiter, family string) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _ := ClientFromContext(r.Context())
+			res, limited, err := limiter.Allow(r.Context(), client, family)
+			if err != nil {
+				logger.Error("error checking rate limit", zap.Error(err), zap.String("client", client))
+				handler.ServeHTTP(w, r)
+				return
+			}
+			if !limited {
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+			if !res.Allowed {
+				logger.Warn("rate limit exceeded", zap.String("client", client), zap.String("route", family))
+				metrics.RateLimited.WithLabelValues(limiter.Label(client), family).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+				writeError(w, r, codeLimitExceeded, "rate limit of the "+family+" routes exceeded")
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"github.com/cernbox/cboxgroupd/pkg/ratelimit"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	limiter, err := ratelimit.New(ratelimit.NewMemoryStore(), []ratelimit.Limit{{Client: "web", Route: "search", Rate: 0.5, Burst: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		client    string
+		code      int
+		remaining string
+		retry     string
+	}{
+		{"web", http.StatusOK, "1", ""},
+		{"web", http.StatusOK, "0", ""},
+		{"web", http.StatusTooManyRequests, "0", "2"},
+		{"sync", http.StatusOK, "", ""},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "/api/v1/search/hugo", nil)
+		req = req.WithContext(WithClient(req.Context(), test.client))
+		rec := httptest.NewRecorder()
+		RateLimit(zap.NewNop(), limiter, "search")(next).ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("request %d: expected %d, got %d", i, test.code, rec.Code)
+		}
+		if got := rec.Header().Get("X-RateLimit-Remaining"); got != test.remaining {
+			t.Errorf("request %d: expected X-RateLimit-Remaining %q, got %q", i, test.remaining, got)
+		}
+		if got := rec.Header().Get("Retry-After"); got != test.retry {
+			t.Errorf("request %d: expected Retry-After %q, got %q", i, test.retry, got)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// recorder gets the spans of the handlers. The tracer of the package only delegates to
+// the first global provider set, so it is set once for all the tests.
+var recorder = func() *tracetest.SpanRecorder {
+	r := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(r)))
+	return r
+}()
+
+func TestTrace(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	router := mux.NewRouter()
+	router.Use(Trace)
+	router.HandleFunc("/api/v1/usergroups/{uid}", func(w http.ResponseWriter, r *http.Request) {
+		switch mux.Vars(r)["uid"] {
+		case "nobody":
+			writeLookupError(w, r, pkg.ErrNotFound)
+		case "down":
+			writeLookupError(w, r, pkg.NewGroupLookerError(pkg.GroupLookerErrorUnavailable).WithCause(errors.New("ldap down")))
+		default:
+			writeJSON(w, http.StatusOK, []string{})
+		}
+	}).Methods("GET")
+
+	tests := []struct {
+		uid    string
+		code   int
+		status codes.Code
+		errors int
+	}{
+		{"alice", http.StatusOK, codes.Unset, 0},
+		{"nobody", http.StatusNotFound, codes.Unset, 0},
+		{"down", http.StatusServiceUnavailable, codes.Error, 1},
+	}
+	for _, test := range tests {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/usergroups/"+test.uid, nil))
+
+		spans := recorder.Ended()
+		span := spans[len(spans)-1]
+		if span.Name() != "GET /api/v1/usergroups/{uid}" || span.SpanKind() != trace.SpanKindServer {
+			t.Errorf("%s: unexpected span %s of kind %s", test.uid, span.Name(), span.SpanKind())
+		}
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, kv := range span.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		if attrs["http.status_code"].AsInt64() != int64(test.code) || attrs["cboxgroupd.uid"].AsString() != test.uid {
+			t.Errorf("%s: unexpected attributes %v", test.uid, span.Attributes())
+		}
+		if span.Status().Code != test.status {
+			t.Errorf("%s: expected status %s, got %s", test.uid, test.status, span.Status().Code)
+		}
+		errs := 0
+		for _, event := range span.Events() {
+			if event.Name == "exception" {
+				errs++
+			}
+		}
+		if errs != test.errors {
+			t.Errorf("%s: expected %d recorded errors, got %v", test.uid, test.errors, span.Events())
+		}
+	}
+
+	// the span continues the trace of the caller
+	req := httptest.NewRequest("GET", "/api/v1/usergroups/alice", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	spans := recorder.Ended()
+	span := spans[len(spans)-1]
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the trace of the traceparent header, got trace %s and parent %s", span.SpanContext().TraceID(), span.Parent().SpanID())
+	}
+}
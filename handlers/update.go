@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/jobs"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// UpdateUsersInGroup refreshes in the background the members of the e-groups listed in
+// {"groups": [...]}, the response is the job to follow at /api/v1/jobs/{id}.
+func UpdateUsersInGroup(logger *zap.Logger, queue *jobs.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &struct {
+			Groups []string `json:"groups"`
+		}{}
+		if !decodeUpdate(w, r, logger, req, "group", &req.Groups) {
+			return
+		}
+		submitJob(w, r, logger, queue, jobs.New(jobs.KindUsersInGroup, req.Groups))
+	})
+}
+
+// UpdateUserGroups refreshes the e-groups of the users listed in {"users": [...]}.
+func UpdateUserGroups(logger *zap.Logger, queue *jobs.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &struct {
+			Users []string `json:"users"`
+		}{}
+		if !decodeUpdate(w, r, logger, req, "user", &req.Users) {
+			return
+		}
+		submitJob(w, r, logger, queue, jobs.New(jobs.KindUserGroups, req.Users))
+	})
+}
+
+// UpdateUsersInComputingGroup is UpdateUsersInGroup for computing groups.
+func UpdateUsersInComputingGroup(logger *zap.Logger, queue *jobs.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &struct {
+			Groups []string `json:"groups"`
+		}{}
+		if !decodeUpdate(w, r, logger, req, "group", &req.Groups) {
+			return
+		}
+		submitJob(w, r, logger, queue, jobs.New(jobs.KindUsersInComputingGroup, req.Groups))
+	})
+}
+
+// UpdateUserComputingGroups is UpdateUserGroups for computing groups.
+func UpdateUserComputingGroups(logger *zap.Logger, queue *jobs.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &struct {
+			Users []string `json:"users"`
+		}{}
+		if !decodeUpdate(w, r, logger, req, "user", &req.Users) {
+			return
+		}
+		submitJob(w, r, logger, queue, jobs.New(jobs.KindUserComputingGroups, req.Users))
+	})
+}
+
+// UpdateSearch refreshes the results of the search filters listed in {"filters": [...]}.
+func UpdateSearch(logger *zap.Logger, queue *jobs.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &struct {
+			Filters []string `json:"filters"`
+		}{}
+		if !decodeUpdate(w, r, logger, req, "filter", &req.Filters) {
+			return
+		}
+		submitJob(w, r, logger, queue, jobs.New(jobs.KindSearch, req.Filters))
+	})
+}
+
+// decodeUpdate reads the JSON body of an update request into req and answers
+// INVALID_ARGUMENT if it cannot, or if one of the ids, the groups, users or filters
+// of req, would be refused by the read routes: empty or with other characters.
+func decodeUpdate(w http.ResponseWriter, r *http.Request, logger *zap.Logger, req interface{}, noun string, ids *[]string) bool {
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(data, req)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		writeError(w, r, codeInvalidArgument, "invalid request body: "+err.Error())
+		return false
+	}
+	for _, id := range *ids {
+		if !isValidFilter(id) {
+			logger.Error(noun+" is invalid", zap.String(noun, id))
+			writeError(w, r, codeInvalidArgument, fmt.Sprintf("%s %q is invalid", noun, id))
+			return false
+		}
+	}
+	return true
+}
+
+// JobStatus returns the progress and the per group or user results of an update job
+func JobStatus(logger *zap.Logger, store jobs.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !isValidFilter(id) {
+			logger.Error("job id is invalid")
+			writeError(w, r, codeInvalidArgument, "job id is invalid")
+			return
+		}
+
+		job, err := store.Get(r.Context(), id)
+		if err != nil {
+			if err == jobs.ErrNotFound {
+				logger.Warn("job not found", zap.String("job", id))
+				writeError(w, r, codeNotFound, "job "+id+" not found")
+				return
+			}
+			logger.Info("error getting job", zap.Error(err), zap.String("job", id))
+			writeError(w, r, codeUnavailable, "job store unavailable")
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	})
+}
+
+// Refresh returns the function used by the update queue to refresh one group, user
+// or search filter bypassing the cache.
+func Refresh(logger *zap.Logger, groupLooker pkg.GroupLooker) jobs.ProcessFunc {
+	return func(ctx context.Context, kind, id string) *jobs.Item {
+		var members int
+		var err error
+		switch kind {
+		case jobs.KindUsersInGroup:
+			members, err = count(groupLooker.GetUsersInGroup(ctx, id, false))
+		case jobs.KindUserGroups:
+			members, err = count(groupLooker.GetUserGroups(ctx, id, false))
+		case jobs.KindUsersInComputingGroup:
+			members, err = count(groupLooker.GetUsersInComputingGroup(ctx, id, false))
+		case jobs.KindUserComputingGroups:
+			members, err = count(groupLooker.GetUserComputingGroups(ctx, id, false))
+		case jobs.KindSearch:
+			var entries []*pkg.SearchEntry
+			entries, err = groupLooker.Search(ctx, id, false)
+			members = len(entries)
+		default:
+			err = fmt.Errorf("unknown job kind %q", kind)
+		}
+
+		result := &jobs.Item{ID: id, Status: jobs.ItemStatusDone, Members: members}
+		if err != nil {
+			if errors.Is(err, pkg.ErrNotFound) {
+				logger.Warn("async: not found", zap.String("kind", kind), zap.String("id", id))
+				result.Status = jobs.ItemStatusNotFound
+			} else {
+				logger.Info("async: error refreshing", zap.Error(err), zap.String("kind", kind), zap.String("id", id))
+				result.Status = jobs.ItemStatusFailed
+				result.Error = err.Error()
+			}
+		} else {
+			logger.Info("async: refreshed", zap.Int("members", members), zap.String("kind", kind), zap.String("id", id))
+		}
+		return result
+	}
+}
+
+func count(members []string, err error) (int, error) {
+	return len(members), err
+}
+
+// submitJob queues the job and answers 202 with it.
+// If the queue is full 429 is returned with an estimation of when to retry, if the job
+// can never fit in the queue 422 is returned and if the server is shutting down 503 is returned.
+func submitJob(w http.ResponseWriter, r *http.Request, logger *zap.Logger, queue *jobs.Queue, job *jobs.Job) {
+	err := queue.Submit(r.Context(), job)
+	switch err {
+	case nil:
+	case jobs.ErrQueueFull:
+		retryAfter := int(queue.RetryAfter().Seconds() + 0.5)
+		logger.Warn("update queue is full", zap.Int("items", job.Total), zap.Int("retryafter", retryAfter))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, r, codeLimitExceeded, "update queue is full")
+		return
+	case jobs.ErrJobTooLarge:
+		logger.Warn("job larger than the update queue", zap.Int("items", job.Total), zap.Int("size", queue.Size()))
+		writeError(w, r, codeTooLarge, fmt.Sprintf("at most %d groups, users or filters per update", queue.Size()))
+		return
+	case jobs.ErrShuttingDown:
+		logger.Warn("job not started", zap.Error(err), zap.String("job", job.ID))
+		writeError(w, r, codeUnavailable, "server is shutting down")
+		return
+	default:
+		logger.Error("error creating job", zap.Error(err))
+		writeError(w, r, codeUnavailable, "job store unavailable")
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/jobs"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingLooker waits for release before answering, or for the context
+// to be cancelled, whatever happens first.
+type blockingLooker struct {
+	pkg.GroupLooker
+	release chan struct{}
+}
+
+func (l *blockingLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	select {
+	case <-l.release:
+	case <-ctx.Done():
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return []string{"hugo"}, nil
+}
+
+func postUpdate(t *testing.T, h http.Handler, ctx context.Context) (*httptest.ResponseRecorder, *jobs.Job) {
+	req := httptest.NewRequest("POST", "/api/v1/update/usersingroup", strings.NewReader(`{"groups": ["cernbox-admins"]}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req.WithContext(ctx))
+	job := &jobs.Job{}
+	if rec.Code == http.StatusAccepted {
+		if err := json.NewDecoder(rec.Body).Decode(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec, job
+}
+
+func TestUpdateSurvivesRequestCancellation(t *testing.T) {
+	looker := &blockingLooker{release: make(chan struct{})}
+	store := jobs.NewMemoryStore(60)
+	queue := jobs.NewQueue(zap.NewNop(), store, Refresh(zap.NewNop(), looker), 10, 100, time.Minute)
+	h := UpdateUsersInGroup(zap.NewNop(), queue)
+
+	// net/http cancels the request context as soon as the handler returns
+	reqCtx, cancel := context.WithCancel(context.Background())
+	rec, job := postUpdate(t, h, reqCtx)
+	cancel()
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rec.Code)
+	}
+
+	close(looker.release)
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get(context.Background(), job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != jobs.StatusFinished || got.Done != 1 || got.Failed != 0 {
+		t.Fatalf("expected finished job without failures, got %+v", got)
+	}
+	if item := got.Items[0]; item.Status != jobs.ItemStatusDone || item.Members != 1 {
+		t.Errorf("expected refreshed item, got %+v", item)
+	}
+}
+
+func TestUpdateInterruptedAtShutdown(t *testing.T) {
+	looker := &blockingLooker{release: make(chan struct{})}
+	store := jobs.NewMemoryStore(60)
+	queue := jobs.NewQueue(zap.NewNop(), store, Refresh(zap.NewNop(), looker), 10, 100, time.Minute)
+	h := UpdateUsersInGroup(zap.NewNop(), queue)
+
+	_, job := postUpdate(t, h, context.Background())
+
+	// the lookup never finishes by itself, so shutdown has to cancel it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := queue.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	got, err := store.Get(context.Background(), job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != jobs.StatusRunning || got.Done != 0 {
+		t.Fatalf("expected interrupted job to stay running, got %+v", got)
+	}
+
+	// no new jobs are accepted after shutdown
+	rec, _ := postUpdate(t, h, context.Background())
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after shutdown, got %d", rec.Code)
+	}
+
+	// the next start resumes the interrupted group
+	close(looker.release)
+	queue = jobs.NewQueue(zap.NewNop(), store, Refresh(zap.NewNop(), looker), 10, 100, time.Minute)
+	if n, err := queue.Resume(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected 1 resumed item, got %d, %v", n, err)
+	}
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Get(context.Background(), job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != jobs.StatusFinished || got.Done != 1 || got.Failed != 0 {
+		t.Errorf("expected resumed job to finish, got %+v", got)
+	}
+}
+
+func TestUpdateQueueFull(t *testing.T) {
+	looker := &blockingLooker{release: make(chan struct{})}
+	store := jobs.NewMemoryStore(60)
+	queue := jobs.NewQueue(zap.NewNop(), store, Refresh(zap.NewNop(), looker), 1, 1, time.Minute)
+	h := UpdateUsersInGroup(zap.NewNop(), queue)
+	defer queue.Shutdown(context.Background())
+	defer close(looker.release)
+
+	req := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/update/usersingroup", strings.NewReader(body)))
+		return rec
+	}
+
+	// the first group keeps the only worker busy, the second one fills the queue
+	if rec := req(`{"groups": ["a"]}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rec.Code)
+	}
+	for queue.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if rec := req(`{"groups": ["b"]}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rec.Code)
+	}
+
+	rec := req(`{"groups": ["c"]}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+
+	// a group already waiting in the queue does not need room
+	if rec := req(`{"groups": ["b"]}`); rec.Code != http.StatusAccepted {
+		t.Errorf("expected 202 for a queued group, got %d", rec.Code)
+	}
+
+	// more new groups than the queue holds would never fit, retrying is pointless
+	rec = req(`{"groups": ["b", "c", "d"]}`)
+	if rec.Code != http.StatusUnprocessableEntity || rec.Header().Get("Retry-After") != "" {
+		t.Errorf("expected 422 without Retry-After, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "at most 1 groups, users or filters per update") {
+		t.Errorf("expected the size of the queue in the error, got %s", rec.Body.String())
+	}
+}
+
+// countingLooker answers every refresh with one member and records the lookups
+type countingLooker struct {
+	pkg.GroupLooker
+	mu      sync.Mutex
+	lookups []string
+}
+
+func (l *countingLooker) record(kind, id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lookups = append(l.lookups, kind+":"+id)
+}
+
+func (l *countingLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	l.record("unixgroup", gid)
+	return []string{"hugo"}, nil
+}
+
+func (l *countingLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	l.record("unixuser", uid)
+	return []string{"zp"}, nil
+}
+
+func (l *countingLooker) Search(ctx context.Context, filter string, cached bool) ([]*pkg.SearchEntry, error) {
+	l.record("filter", filter)
+	return []*pkg.SearchEntry{{CN: "hugo"}}, nil
+}
+
+func TestUpdateComputingAndSearch(t *testing.T) {
+	looker := &countingLooker{}
+	store := jobs.NewMemoryStore(60)
+	queue := jobs.NewQueue(zap.NewNop(), store, Refresh(zap.NewNop(), looker), 2, 100, time.Minute)
+
+	tests := []struct {
+		h    http.Handler
+		body string
+	}{
+		{UpdateUsersInComputingGroup(zap.NewNop(), queue), `{"groups": ["zp"]}`},
+		{UpdateUserComputingGroups(zap.NewNop(), queue), `{"users": ["hugo"]}`},
+		{UpdateSearch(zap.NewNop(), queue), `{"filters": ["a:hugo"]}`},
+	}
+	var ids []string
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		test.h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(test.body)))
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("expected 202 for %s, got %d", test.body, rec.Code)
+		}
+		job := &jobs.Job{}
+		if err := json.NewDecoder(rec.Body).Decode(job); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		got, err := store.Get(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != jobs.StatusFinished || got.Items[0].Status != jobs.ItemStatusDone || got.Items[0].Members != 1 {
+			t.Errorf("expected refreshed item, got %+v", got)
+		}
+	}
+	if len(looker.lookups) != 3 {
+		t.Errorf("expected 3 lookups, got %v", looker.lookups)
+	}
+
+	rec := httptest.NewRecorder()
+	UpdateSearch(zap.NewNop(), queue).ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"filters": ["(cn=*)"]}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid filter, got %d", rec.Code)
+	}
+}
+
+func TestUpdateInvalidIDs(t *testing.T) {
+	looker := &countingLooker{}
+	queue := jobs.NewQueue(zap.NewNop(), jobs.NewMemoryStore(60), Refresh(zap.NewNop(), looker), 1, 100, time.Minute)
+	defer queue.Shutdown(context.Background())
+
+	tests := []struct {
+		h    http.Handler
+		body string
+	}{
+		{UpdateUsersInGroup(zap.NewNop(), queue), `{"groups": ["cernbox-admins", ""]}`},
+		{UpdateUsersInGroup(zap.NewNop(), queue), `{"groups": ["a,OU=Other"]}`},
+		{UpdateUserGroups(zap.NewNop(), queue), `{"users": [""]}`},
+		{UpdateUserGroups(zap.NewNop(), queue), `{"users": ["hugo*"]}`},
+		{UpdateUsersInComputingGroup(zap.NewNop(), queue), `{"groups": ["(zp)"]}`},
+		{UpdateUserComputingGroups(zap.NewNop(), queue), `{"users": ["hugo", ""]}`},
+		{UpdateSearch(zap.NewNop(), queue), `{"filters": ["(cn=*)"]}`},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		test.h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(test.body)))
+		res := &Error{}
+		if err := json.NewDecoder(rec.Body).Decode(res); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusBadRequest || res.Code != codeInvalidArgument {
+			t.Errorf("expected INVALID_ARGUMENT for %s, got %d %+v", test.body, rec.Code, res)
+		}
+	}
+	if n := queue.Len(); n != 0 {
+		t.Errorf("expected nothing queued, got %d items", n)
+	}
+}
@@ -1,19 +1,39 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/cernbox/cboxgroupd/handlers"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/audit"
+	"github.com/cernbox/cboxgroupd/pkg/boltgrouplooker"
+	"github.com/cernbox/cboxgroupd/pkg/cachestats"
+	"github.com/cernbox/cboxgroupd/pkg/clients"
+	"github.com/cernbox/cboxgroupd/pkg/jobs"
+	"github.com/cernbox/cboxgroupd/pkg/jwtauth"
 	"github.com/cernbox/cboxgroupd/pkg/ldapgrouplooker"
+	"github.com/cernbox/cboxgroupd/pkg/logfile"
+	"github.com/cernbox/cboxgroupd/pkg/memorygrouplooker"
+	"github.com/cernbox/cboxgroupd/pkg/metrics"
+	"github.com/cernbox/cboxgroupd/pkg/policy"
+	"github.com/cernbox/cboxgroupd/pkg/ratelimit"
 	"github.com/cernbox/cboxgroupd/pkg/redisgrouplooker"
-	gh "github.com/gorilla/handlers"
+	"github.com/cernbox/cboxgroupd/pkg/tlsconfig"
+	"github.com/cernbox/cboxgroupd/pkg/tracing"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 // Build information obtained with the help of -ldflags
@@ -37,10 +57,35 @@ func init() {
 	viper.SetDefault("redisport", 6379)
 	viper.SetDefault("redisdb", 0)
 	viper.SetDefault("redisttl", 60)
+	viper.SetDefault("cachebackend", "redis")
+	viper.SetDefault("cachettl", 60)
+	viper.SetDefault("boltpath", "/var/lib/cboxgroupd/cboxgroupd.db")
+	viper.SetDefault("memorymaxentries", 100000)
+	viper.SetDefault("memorycleanupinterval", 60)
+	viper.SetDefault("metricsauth", false)
+	viper.SetDefault("tracingexporter", "none")
+	viper.SetDefault("tracingendpoint", "localhost:4318")
+	viper.SetDefault("tracinginsecure", true)
 	viper.SetDefault("applog", "stderr")
+	viper.SetDefault("loglevel", "info")
 	viper.SetDefault("httplog", "stderr")
-	viper.SetDefault("secret", "change_me!!!")
+	viper.SetDefault("secret", "")
+	viper.SetDefault("authmaxfailures", 10)
+	viper.SetDefault("authfailurewindow", 60)
 	viper.SetDefault("ldapmaxconcurrency", 10)
+	viper.SetDefault("jobttl", 86400)
+	viper.SetDefault("jobtimeout", 3600)
+	viper.SetDefault("updatequeuesize", 10000)
+	viper.SetDefault("shutdowntimeout", 30)
+	viper.SetDefault("batchmaxitems", 500)
+	viper.SetDefault("batchconcurrency", 10)
+	viper.SetDefault("tlsminversion", "1.2")
+	viper.SetDefault("tlsclientauth", "none")
+	viper.SetDefault("ratelimitbackend", "memory")
+	viper.SetDefault("jwtjwksrefresh", 3600)
+	viper.SetDefault("jwtreadscope", "groups:read")
+	viper.SetDefault("jwtupdatescope", "groups:update")
+	viper.SetDefault("jwtadminscope", "groups:admin")
 
 	viper.SetConfigName("cboxgroupd")
 	viper.AddConfigPath("/etc/cboxgroupd/")
@@ -56,10 +101,42 @@ func init() {
 	flag.Int("redisport", 6379, "Port of Redis server")
 	flag.Int("redisdb", 0, "Redis number database for keys isolation (0-15)")
 	flag.Int("redisttl", 60, "Number of seconds to expire cached entries in Redis")
+	flag.String("cachebackend", "redis", "Cache backend to use (redis, bolt, memory)")
+	flag.Int("cachettl", 60, "Number of seconds to expire cached entries for non Redis cache backends")
+	flag.String("boltpath", "/var/lib/cboxgroupd/cboxgroupd.db", "File to store the cache when using the bolt cache backend")
+	flag.Int("memorymaxentries", 100000, "Maximum number of cached entries when using the memory cache backend")
+	flag.Int("memorycleanupinterval", 60, "Number of seconds between removals of expired entries when using the memory cache backend")
 	flag.String("applog", "stderr", "File to log application data")
 	flag.String("httplog", "stderr", "File to log HTTP requests")
-	flag.String("secret", "changeme!!!", "Share secret between services to authenticate requests")
-	flag.Int("ldapmaxconcurrency", 100, "Number of concurrent connections to LDAP for update operations")
+	flag.String("auditlog", "", "File to log the update and admin actions as JSON lines (disabled if empty)")
+	flag.String("loglevel", "info", "Level of the application log (debug, info, warn, error)")
+	flag.String("secret", "", "Share secret between services to authenticate requests, accepted as the client default (disabled if empty)")
+	flag.Int("authmaxfailures", 10, "Number of authentication failures after which a source is blocked until the end of the window (0 disables it)")
+	flag.Int("authfailurewindow", 60, "Number of seconds of the window to count authentication failures")
+	flag.Int("ldapmaxconcurrency", 100, "Number of workers refreshing groups and users for update operations")
+	flag.Int("jobttl", 86400, "Number of seconds to keep the status of update jobs")
+	flag.Int("jobtimeout", 3600, "Number of seconds after which a queued group or user of an update job is cancelled")
+	flag.Int("updatequeuesize", 10000, "Maximum number of groups and users waiting to be refreshed by update operations")
+	flag.Int("shutdowntimeout", 30, "Number of seconds to drain requests and update jobs at shutdown")
+	flag.Int("batchmaxitems", 500, "Maximum number of groups or users of a batch membership request")
+	flag.Int("batchconcurrency", 10, "Number of groups or users of a batch membership request looked up at the same time when not cached")
+	flag.Bool("metricsauth", false, "Require the authentication and the scope of the admin routes on /metrics")
+	flag.String("tracingexporter", "none", "Exporter for the OpenTelemetry traces (none, stdout, otlp)")
+	flag.String("tracingendpoint", "localhost:4318", "Endpoint of the OTLP HTTP collector")
+	flag.Bool("tracinginsecure", true, "Send the traces to the OTLP HTTP collector without TLS")
+	flag.String("tlscert", "", "Certificate to serve HTTPS, plain HTTP is served if empty")
+	flag.String("tlskey", "", "Private key of the HTTPS certificate")
+	flag.String("tlsminversion", "1.2", "Minimum TLS version (1.0, 1.1, 1.2, 1.3)")
+	flag.String("tlsclientca", "", "CA to verify the client certificates")
+	flag.String("tlsclientauth", "none", "Client certificate authentication (none, optional, require)")
+	flag.String("ratelimitbackend", "memory", "Where to count the requests for the rate limits (memory, redis to share them between instances)")
+	flag.String("jwtissuer", "", "Issuer of the accepted JWTs, required with jwtjwks")
+	flag.String("jwtaudience", "", "Audience of the accepted JWTs, required with jwtjwks")
+	flag.String("jwtjwks", "", "File or https URL of the JWKS verifying the JWTs, JWTs are not accepted if empty")
+	flag.Int("jwtjwksrefresh", 3600, "Number of seconds between downloads of the JWKS when it is an URL")
+	flag.String("jwtreadscope", "groups:read", "Scope a JWT needs for the membership and search routes")
+	flag.String("jwtupdatescope", "groups:update", "Scope a JWT needs for the update and job routes")
+	flag.String("jwtadminscope", "groups:admin", "Scope a JWT needs for the admin routes")
 	flag.String("config", "", "Configuration file to use")
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
@@ -82,33 +159,158 @@ func main() {
 		panic(fmt.Errorf("Fatal error config file: %s \n", err))
 	}
 
+	applog, err := logfile.Open(viper.GetString("applog"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	level := zap.NewAtomicLevel()
+	if err := level.UnmarshalText([]byte(viper.GetString("loglevel"))); err != nil {
+		log.Fatal(err)
+	}
+	// same as zap.NewProductionConfig().Build() but on a file that can be reopened
 	config := zap.NewProductionConfig()
-	config.OutputPaths = []string{viper.GetString("applog")}
-	logger, _ := config.Build()
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(config.EncoderConfig), applog, level)
+	core = zapcore.NewSampler(core, time.Second, config.Sampling.Initial, config.Sampling.Thereafter)
+	logger := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
 
-	lgl := ldapgrouplooker.New(viper.GetString("ldaphostname"), viper.GetInt("ldapport"), uint32(viper.GetInt("ldappagelimit")))
-	rgl := redisgrouplooker.New(viper.GetString("redishostname"), viper.GetInt("redisport"), viper.GetInt("redisdb"), viper.GetInt("redisttl"), viper.GetString("redispassword"), lgl)
+	shutdownTracing, err := tracing.Init(viper.GetString("tracingexporter"), viper.GetString("tracingendpoint"), viper.GetBool("tracinginsecure"), "cboxgroupd")
+	if err != nil {
+		logger.Fatal("error initializing tracing", zap.Error(err))
+	}
+	defer shutdownTracing(context.Background())
+
+	ldapgl := ldapgrouplooker.New(viper.GetString("ldaphostname"), viper.GetInt("ldapport"), uint32(viper.GetInt("ldappagelimit")))
+	lgl := metrics.NewGroupLooker(ldapgl)
+	rgl, err := getCachedGroupLooker(lgl)
+	if err != nil {
+		logger.Fatal("error creating cache backend", zap.Error(err), zap.String("cachebackend", viper.GetString("cachebackend")))
+	}
+
+	store := getJobStore(logger)
+	queue := jobs.NewQueue(logger, store, handlers.Refresh(logger, rgl), viper.GetInt("ldapmaxconcurrency"), viper.GetInt("updatequeuesize"), time.Second*time.Duration(viper.GetInt("jobtimeout")))
+	if n, err := queue.Resume(context.Background()); err != nil {
+		logger.Error("error resuming interrupted update items", zap.Error(err))
+	} else if n > 0 {
+		logger.Info("interrupted update items resumed", zap.Int("items", n))
+	}
+
+	apiClients, err := getClients()
+	if err != nil {
+		logger.Fatal("error reading clients", zap.Error(err))
+	}
+	registry, err := clients.New(apiClients)
+	if err != nil {
+		logger.Fatal("error reading clients", zap.Error(err))
+	}
+	// closed at shutdown to stop the background refreshes
+	done := make(chan struct{})
+	limiter := handlers.NewFailureLimiter(viper.GetInt("authmaxfailures"), time.Second*time.Duration(viper.GetInt("authfailurewindow")))
+	proxies, err := handlers.ParseProxies(viper.GetStringSlice("trustedproxies"))
+	if err != nil {
+		logger.Fatal("error reading trustedproxies", zap.Error(err))
+	}
+	limiter.SetTrustedProxies(proxies)
+	go limiter.Janitor(done)
+	verifier, err := getVerifier(logger, done)
+	if err != nil {
+		logger.Fatal("error loading JWKS", zap.Error(err), zap.String("jwtjwks", viper.GetString("jwtjwks")))
+	}
+	apiPolicies, err := getPolicies()
+	if err != nil {
+		logger.Fatal("error reading policies", zap.Error(err))
+	}
+	policies, err := policy.New(apiPolicies)
+	if err != nil {
+		logger.Fatal("error reading policies", zap.Error(err))
+	}
+	rateLimits, err := getRateLimits()
+	if err != nil {
+		logger.Fatal("error reading rate limits", zap.Error(err))
+	}
+	rateStore := getRateLimitStore()
+	rateLimiter, err := ratelimit.New(rateStore, rateLimits)
+	if err != nil {
+		logger.Fatal("error reading rate limits", zap.Error(err))
+	}
+	var auditfile *logfile.File
+	var auditLog *audit.Log
+	if path := viper.GetString("auditlog"); path != "" {
+		// the audit log names the clients and what they did, only root reads it
+		auditfile, err = logfile.OpenMode(path, 0600)
+		if err != nil {
+			logger.Fatal("error opening audit log", zap.Error(err), zap.String("auditlog", path))
+		}
+		auditLog = audit.New(auditfile)
+	}
+	authenticate := handlers.Authenticate(logger, registry, verifier, limiter)
+	auditActions := handlers.Audit(logger, auditLog)
+	// protect records the actions on the update and admin routes, including the failed
+	// authentications, authenticates the client, applies its rate limit, then checks the
+	// scope of its JWT and its policy.
+	// The batch membership routes are POSTs but only read, they are not audited.
+	protect := func(scope, family string) func(http.Handler) http.Handler {
+		rateLimit := handlers.RateLimit(logger, rateLimiter, family)
+		requireScope := handlers.RequireScope(logger, scope)
+		authorize := handlers.Authorize(logger, policies, family)
+		audited := family == policy.Update || family == policy.Admin
+		return func(h http.Handler) http.Handler {
+			h = authenticate(rateLimit(requireScope(authorize(h))))
+			if audited {
+				h = auditActions(h)
+			}
+			return h
+		}
+	}
+	membership := protect(viper.GetString("jwtreadscope"), policy.Membership)
+	search := protect(viper.GetString("jwtreadscope"), policy.Search)
+	update := protect(viper.GetString("jwtupdatescope"), policy.Update)
+	admin := protect(viper.GetString("jwtadminscope"), policy.Admin)
 
 	router := mux.NewRouter()
+	router.NotFoundHandler = handlers.NotFound()
+	router.Use(metrics.InstrumentRoutes)
+	router.Use(handlers.Trace)
 
-	protectedUsersInGroup := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.UsersInGroup(logger, rgl))
-	protectedUsersInComputingGroup := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.UsersInComputingGroup(logger, rgl))
-	protectedUserGroups := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.UserGroups(logger, rgl))
-	protectedUserComputingGroups := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.UserComputingGroups(logger, rgl))
-	protectedUsersInGroupTTL := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.UsersInGroupTTL(logger, rgl))
-	protectedUsersInComputingGroupTTL := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.UsersInComputingGroupTTL(logger, rgl))
-	protectedUserGroupsTTL := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.UserGroupsTTL(logger, rgl))
-	protectedUserComputingGroupsTTL := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.UserComputingGroupsTTL(logger, rgl))
+	protectedUsersInGroup := membership(handlers.UsersInGroup(logger, rgl))
+	protectedUsersInComputingGroup := membership(handlers.UsersInComputingGroup(logger, rgl))
+	protectedUserGroups := membership(handlers.UserGroups(logger, rgl))
+	protectedUserComputingGroups := membership(handlers.UserComputingGroups(logger, rgl))
+	protectedIsMember := membership(handlers.IsMember(logger, rgl))
+	protectedIsMemberOfComputingGroup := membership(handlers.IsMemberOfComputingGroup(logger, rgl))
+	batchMaxItems, batchConcurrency := viper.GetInt("batchmaxitems"), viper.GetInt("batchconcurrency")
+	// the bodies are limited before anything reads them, the audit and the policies included
+	batchBody := handlers.LimitBody(logger, batchMaxItems)
+	protectedBatchUsersInGroup := batchBody(membership(handlers.BatchUsersInGroup(logger, rgl, batchMaxItems, batchConcurrency)))
+	protectedBatchUsersInComputingGroup := batchBody(membership(handlers.BatchUsersInComputingGroup(logger, rgl, batchMaxItems, batchConcurrency)))
+	protectedBatchUserGroups := batchBody(membership(handlers.BatchUserGroups(logger, rgl, batchMaxItems, batchConcurrency)))
+	protectedBatchUserComputingGroups := batchBody(membership(handlers.BatchUserComputingGroups(logger, rgl, batchMaxItems, batchConcurrency)))
+	protectedUsersInGroupTTL := membership(handlers.UsersInGroupTTL(logger, rgl))
+	protectedUsersInComputingGroupTTL := membership(handlers.UsersInComputingGroupTTL(logger, rgl))
+	protectedUserGroupsTTL := membership(handlers.UserGroupsTTL(logger, rgl))
+	protectedUserComputingGroupsTTL := membership(handlers.UserComputingGroupsTTL(logger, rgl))
 
-	protectedUpdateUsersInGroup := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.UpdateUsersInGroup(logger, rgl, viper.GetInt("ldapmaxconcurrency")))
-	protectedUpdateUserGroups := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.UpdateUserGroups(logger, rgl, viper.GetInt("ldapmaxconcurrency")))
+	// a job larger than the update queue is refused anyway
+	updateBody := handlers.LimitBody(logger, viper.GetInt("updatequeuesize"))
+	protectedUpdateUsersInGroup := updateBody(update(handlers.UpdateUsersInGroup(logger, queue)))
+	protectedUpdateUserGroups := updateBody(update(handlers.UpdateUserGroups(logger, queue)))
+	protectedUpdateUsersInComputingGroup := updateBody(update(handlers.UpdateUsersInComputingGroup(logger, queue)))
+	protectedUpdateUserComputingGroups := updateBody(update(handlers.UpdateUserComputingGroups(logger, queue)))
+	protectedUpdateSearch := updateBody(update(handlers.UpdateSearch(logger, queue)))
+	protectedJobStatus := update(handlers.JobStatus(logger, store))
 
-	protectedSearch := handlers.CheckSharedSecret(logger, viper.GetString("secret"), handlers.Search(logger, rgl))
+	protectedSearch := search(handlers.Search(logger, rgl))
 
 	router.Handle("/api/v1/membership/usersingroup/{gid}", protectedUsersInGroup).Methods("GET")
 	router.Handle("/api/v1/membership/usersincomputinggroup/{gid}", protectedUsersInComputingGroup).Methods("GET")
 	router.Handle("/api/v1/membership/usergroups/{uid}", protectedUserGroups).Methods("GET")
 	router.Handle("/api/v1/membership/usercomputinggroups/{uid}", protectedUserComputingGroups).Methods("GET")
+	router.Handle("/api/v1/membership/ismember/{uid}/{gid}", protectedIsMember).Methods("GET")
+	router.Handle("/api/v1/membership/ismemberofcomputinggroup/{uid}/{gid}", protectedIsMemberOfComputingGroup).Methods("GET")
+
+	router.Handle("/api/v1/membership/batch/usersingroup", protectedBatchUsersInGroup).Methods("POST")
+	router.Handle("/api/v1/membership/batch/usersincomputinggroup", protectedBatchUsersInComputingGroup).Methods("POST")
+	router.Handle("/api/v1/membership/batch/usergroups", protectedBatchUserGroups).Methods("POST")
+	router.Handle("/api/v1/membership/batch/usercomputinggroups", protectedBatchUserComputingGroups).Methods("POST")
 
 	router.Handle("/api/v1/membership/usersingroupttl/{gid}", protectedUsersInGroupTTL).Methods("GET")
 	router.Handle("/api/v1/membership/usersincomputinggroupttl/{gid}", protectedUsersInComputingGroupTTL).Methods("GET")
@@ -117,28 +319,288 @@ func main() {
 
 	router.Handle("/api/v1/update/usersingroup", protectedUpdateUsersInGroup).Methods("POST")
 	router.Handle("/api/v1/update/usergroups", protectedUpdateUserGroups).Methods("POST")
+	router.Handle("/api/v1/update/usersincomputinggroup", protectedUpdateUsersInComputingGroup).Methods("POST")
+	router.Handle("/api/v1/update/usercomputinggroups", protectedUpdateUserComputingGroups).Methods("POST")
+	router.Handle("/api/v1/update/search", protectedUpdateSearch).Methods("POST")
+	router.Handle("/api/v1/jobs/{id}", protectedJobStatus).Methods("GET")
 
 	router.Handle("/api/v1/search/{filter}", protectedSearch).Methods("GET")
 
-	out := getHTTPLoggerOut(viper.GetString("httplog"))
-	loggedRouter := gh.LoggingHandler(out, router)
+	if reporter, ok := rgl.(cachestats.Reporter); ok {
+		protectedCacheStats := admin(handlers.CacheStats(logger, reporter.Stats()))
+		protectedResetCacheStats := admin(handlers.ResetCacheStats(logger, reporter.Stats()))
+		router.Handle("/api/v1/admin/cachestats", protectedCacheStats).Methods("GET")
+		router.Handle("/api/v1/admin/cachestats", protectedResetCacheStats).Methods("DELETE")
+	}
 
-	logger.Info("server is listening", zap.Int("port", viper.GetInt("port")))
-	logger.Warn("server stopped", zap.Error(http.ListenAndServe(fmt.Sprintf("%s:%d", viper.GetString("network"), viper.GetInt("port")), loggedRouter)))
-}
+	// /metrics is scraped every few seconds, it is neither audited nor rate limited
+	metricsHandler := promhttp.Handler()
+	if viper.GetBool("metricsauth") {
+		requireScope := handlers.RequireScope(logger, viper.GetString("jwtadminscope"))
+		authorize := handlers.Authorize(logger, policies, policy.Admin)
+		metricsHandler = authenticate(requireScope(authorize(metricsHandler)))
+	}
+	router.Handle("/metrics", metricsHandler).Methods("GET")
+
+	readiness := &handlers.Readiness{}
+	checks := []handlers.Check{{Name: "ldap", Pinger: ldapgl.(pkg.Pinger)}}
+	if pinger, ok := rgl.(pkg.Pinger); ok {
+		checks = append(checks, handlers.Check{Name: viper.GetString("cachebackend"), Pinger: pinger})
+	}
+	router.Handle("/healthz", handlers.Healthz()).Methods("GET")
+	router.Handle("/readyz", handlers.Readyz(logger, readiness, checks, 5*time.Second)).Methods("GET")
 
-func getHTTPLoggerOut(filename string) *os.File {
-	if filename == "stderr" {
-		return os.Stderr
-	} else if filename == "stdout" {
-		return os.Stdout
-	} else {
-		fd, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	httplog, err := logfile.Open(viper.GetString("httplog"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	subjects, err := getTLSClients()
+	if err != nil {
+		logger.Fatal("error reading tlsclients", zap.Error(err))
+	}
+	loggedRouter := handlers.AccessLog(httplog, handlers.RequestID(handlers.ClientCertificate(logger, subjects, router)))
+
+	var tlsconf *tlsconfig.Config
+	if viper.GetString("tlscert") != "" {
+		tlsconf, err = tlsconfig.New(viper.GetString("tlscert"), viper.GetString("tlskey"), viper.GetString("tlsclientca"), viper.GetString("tlsminversion"), viper.GetString("tlsclientauth"))
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("error loading TLS configuration", zap.Error(err))
+		}
+	}
+
+	logs := []*logfile.File{applog, httplog}
+	if auditfile != nil {
+		logs = append(logs, auditfile)
+	}
+	live := &liveSettings{
+		logger:   logger,
+		level:    level,
+		logs:     logs,
+		clients:  registry,
+		failures: limiter,
+		policies: policies,
+		limits:   rateLimiter,
+		jwt:      verifier,
+		cache:    rgl,
+		queue:    queue,
+		tls:      tlsconf,
+		startup:  snapshot(restartSettings),
+	}
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", viper.GetString("network"), viper.GetInt("port")),
+		Handler: loggedRouter,
+	}
+	go func() {
+		logger.Info("server is listening", zap.Int("port", viper.GetInt("port")), zap.Bool("tls", tlsconf != nil))
+		var err error
+		if tlsconf != nil {
+			srv.TLSConfig = tlsconf.TLSConfig()
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
 		}
-		return fd
+		if err != http.ErrServerClosed {
+			logger.Fatal("server stopped", zap.Error(err))
+		}
+	}()
+
+	// SIGHUP reopens the log files and reloads the configuration
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range sig {
+		if s == syscall.SIGHUP {
+			if err := live.reload(); err != nil {
+				logger.Error("configuration not reloaded", zap.Error(err))
+			} else {
+				logger.Info("configuration reloaded")
+			}
+			continue
+		}
+		logger.Info("signal received, shutting down", zap.String("signal", s.String()))
+		break
+	}
+
+	// report not ready and drain the update queue while still answering the lookups,
+	// then stop accepting connections and drain the requests, all within the same deadline.
+	// The items not refreshed in time are saved to be resumed.
+	readiness.SetDraining()
+	close(done)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(viper.GetInt("shutdowntimeout")))
+	defer cancel()
+	if err := queue.Shutdown(ctx); err != nil {
+		logger.Warn("update queue interrupted", zap.Error(err))
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("requests interrupted", zap.Error(err))
+	}
+
+	// the LDAP looker opens a connection per lookup, nothing is left open once drained
+	closeAll(logger, rgl, store, rateStore)
+	logger.Info("server stopped")
+	logger.Sync()
+}
+
+// closeAll closes the cache, the job store and the rate limit store if they hold connections or files,
+// the memory job store reports the update items it drops
+func closeAll(logger *zap.Logger, resources ...interface{}) {
+	for _, r := range resources {
+		if c, ok := r.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				logger.Warn("error closing", zap.Error(err))
+			}
+		}
+	}
+}
+
+func getCachedGroupLooker(wrapped pkg.GroupLooker) (pkg.GroupLooker, error) {
+	switch viper.GetString("cachebackend") {
+	case "redis":
+		return redisgrouplooker.New(viper.GetString("redishostname"), viper.GetInt("redisport"), viper.GetInt("redisdb"), viper.GetInt("redisttl"), viper.GetString("redispassword"), wrapped), nil
+	case "bolt":
+		return boltgrouplooker.New(viper.GetString("boltpath"), viper.GetInt("cachettl"), wrapped)
+	case "memory":
+		return memorygrouplooker.New(viper.GetInt("cachettl"), viper.GetInt("memorymaxentries"), time.Second*time.Duration(viper.GetInt("memorycleanupinterval")), wrapped), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", viper.GetString("cachebackend"))
+	}
+}
+
+// placeholderSecrets are the defaults the legacy secret used to have and the one of the
+// sample configuration, known to anyone who has read them.
+var placeholderSecrets = map[string]bool{"change_me!!!": true, "changeme!!!": true, "change me!!!": true}
+
+// getClients returns the API clients of the configuration. The legacy secret, unless
+// it is empty, is accepted as the client named default. It has no default value so it
+// is only accepted when it is set explicitly, and never with one of the placeholders.
+func getClients() ([]clients.Client, error) {
+	var config []struct {
+		Name    string
+		Secrets []struct {
+			Secret string
+			Hash   string
+			// a date or a RFC 3339 time, YAML decodes unquoted ones to time.Time
+			Expires interface{}
+		}
+	}
+	if err := viper.UnmarshalKey("clients", &config); err != nil {
+		return nil, err
+	}
+
+	var list []clients.Client
+	for _, c := range config {
+		client := clients.Client{Name: c.Name}
+		for _, s := range c.Secrets {
+			secret := clients.Secret{Secret: s.Secret, Hash: s.Hash}
+			switch v := s.Expires.(type) {
+			case nil:
+			case time.Time:
+				secret.Expires = v
+			case string:
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					if t, err = time.Parse("2006-01-02", v); err != nil {
+						return nil, fmt.Errorf("invalid expiration %q of client %s", v, c.Name)
+					}
+				}
+				secret.Expires = t
+			default:
+				return nil, fmt.Errorf("invalid expiration %v of client %s", v, c.Name)
+			}
+			client.Secrets = append(client.Secrets, secret)
+		}
+		list = append(list, client)
+	}
+
+	s := viper.GetString("secret")
+	if placeholderSecrets[s] {
+		return nil, fmt.Errorf("secret %q is a placeholder, set another one or remove it", s)
+	}
+	if s != "" {
+		list = append(list, clients.Client{Name: "default", Secrets: []clients.Secret{{Secret: s}}})
+	}
+	return list, nil
+}
+
+// getTLSClients returns the client names by certificate subject
+func getTLSClients() (map[string]string, error) {
+	var clients []struct {
+		Name    string
+		Subject string
+	}
+	if err := viper.UnmarshalKey("tlsclients", &clients); err != nil {
+		return nil, err
+	}
+	subjects := map[string]string{}
+	for _, c := range clients {
+		subjects[c.Subject] = c.Name
+	}
+	return subjects, nil
+}
+
+// getPolicies reads the policies restricting the clients to some routes and groups.
+func getPolicies() ([]policy.Policy, error) {
+	var list []policy.Policy
+	if err := viper.UnmarshalKey("policies", &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// getRateLimits reads the rate limits of the clients per route family.
+func getRateLimits() ([]ratelimit.Limit, error) {
+	var list []ratelimit.Limit
+	if err := viper.UnmarshalKey("ratelimits", &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// getRateLimitStore counts the requests in Redis when the limits are shared between instances
+func getRateLimitStore() ratelimit.Store {
+	if viper.GetString("ratelimitbackend") == "redis" {
+		return ratelimit.NewRedisStore(viper.GetString("redishostname"), viper.GetInt("redisport"), viper.GetInt("redisdb"), viper.GetString("redispassword"))
+	}
+	return ratelimit.NewMemoryStore()
+}
+
+// getVerifier returns nil when JWTs are not accepted. A JWKS downloaded from an URL is
+// refreshed every jwtjwksrefresh seconds so the keys can be rotated by the issuer,
+// until done is closed.
+func getVerifier(logger *zap.Logger, done <-chan struct{}) (*jwtauth.Verifier, error) {
+	if viper.GetString("jwtjwks") == "" {
+		return nil, nil
+	}
+	verifier, err := jwtauth.New(viper.GetString("jwtissuer"), viper.GetString("jwtaudience"), viper.GetString("jwtjwks"))
+	if err != nil {
+		return nil, err
+	}
+	if refresh := viper.GetInt("jwtjwksrefresh"); verifier.IsRemote() && refresh > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Second * time.Duration(refresh))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := verifier.Reload(); err != nil {
+						logger.Error("error refreshing JWKS", zap.Error(err))
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	return verifier, nil
+}
+
+// getJobStore keeps the update jobs in Redis when it is available so any instance can report them
+func getJobStore(logger *zap.Logger) jobs.Store {
+	if viper.GetString("cachebackend") == "redis" {
+		return jobs.NewRedisStore(viper.GetString("redishostname"), viper.GetInt("redisport"), viper.GetInt("redisdb"), viper.GetString("redispassword"), viper.GetInt("jobttl"))
 	}
+	logger.Warn("update jobs are kept in memory, the items not refreshed at shutdown are dropped instead of resumed")
+	return jobs.NewMemoryStore(viper.GetInt("jobttl"))
 }
 
 func showVersion() {
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event is an entry of the audit log: who did what, when, and how it ended.
+type Event struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Client    string    `json:"client"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Groups    []string  `json:"groups,omitempty"`
+	Users     []string  `json:"users,omitempty"`
+	Filters   []string  `json:"filters,omitempty"`
+	Job       string    `json:"job,omitempty"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+}
+
+// Outcome summarizes the status of the response of an audited request.
+func Outcome(status int) string {
+	switch {
+	case status < 400:
+		return "accepted"
+	case status == http.StatusUnauthorized:
+		return "unauthenticated"
+	case status == http.StatusForbidden:
+		return "denied"
+	case status == http.StatusTooManyRequests:
+		return "limited"
+	case status < 500:
+		return "rejected"
+	default:
+		return "failed"
+	}
+}
+
+// Log writes the events as one JSON object per line. Lines are only appended.
+type Log struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// New returns a Log writing to out, usually a logfile.File reopened on SIGHUP.
+func New(out io.Writer) *Log {
+	return &Log{out: out}
+}
+
+// Record writes e.
+func (l *Log) Record(e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.out.Write(data)
+	return err
+}
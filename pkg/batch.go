@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+)
+
+// BatchResult is the answer for one of the groups or users of a batch lookup:
+// its members or groups, or the error looking it up.
+type BatchResult struct {
+	List []string
+	Err  error
+}
+
+// BatchGroupLooker is implemented by the GroupLookers that look up many groups or users
+// at once more cheaply than one by one. The result has an entry for every id, the misses
+// of the cache are looked up at most concurrency at a time.
+type BatchGroupLooker interface {
+	GetUsersInGroups(ctx context.Context, gids []string, concurrency int) map[string]*BatchResult
+	GetGroupsOfUsers(ctx context.Context, uids []string, concurrency int) map[string]*BatchResult
+	GetUsersInComputingGroups(ctx context.Context, gids []string, concurrency int) map[string]*BatchResult
+	GetComputingGroupsOfUsers(ctx context.Context, uids []string, concurrency int) map[string]*BatchResult
+}
+
+// Batch looks up every id with lookup, at most concurrency at a time.
+// Once ctx is done the ids not started yet get its error without being looked up.
+func Batch(ctx context.Context, ids []string, concurrency int, lookup func(ctx context.Context, id string) ([]string, error)) map[string]*BatchResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make(map[string]*BatchResult, len(ids))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			// a slot taken meanwhile is not given back, nothing else is started
+			mu.Lock()
+			results[id] = &BatchResult{Err: err}
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			list, err := lookup(ctx, id)
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[id] = &BatchResult{List: list, Err: err}
+		}(id)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	var running, max int32
+	lookup := func(ctx context.Context, id string) ([]string, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if id == "nobody" {
+			return nil, NewGroupLookerError(GroupLookerErrorNotFound)
+		}
+		return []string{id + "-group"}, nil
+	}
+
+	ids := []string{"a", "b", "c", "d", "e", "nobody"}
+	results := Batch(context.Background(), ids, 2, lookup)
+	if len(results) != len(ids) {
+		t.Fatalf("expected %d results, got %d", len(ids), len(results))
+	}
+	if res := results["a"]; res.Err != nil || len(res.List) != 1 || res.List[0] != "a-group" {
+		t.Errorf("unexpected result for a: %+v", res)
+	}
+	if res := results["nobody"]; !errors.Is(res.Err, ErrNotFound) {
+		t.Errorf("expected not found for nobody, got %+v", res)
+	}
+	if max > 2 {
+		t.Errorf("expected at most 2 concurrent lookups, got %d", max)
+	}
+}
+
+func TestBatchCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+	results := Batch(ctx, []string{"a", "b", "c", "d"}, 1, func(ctx context.Context, id string) ([]string, error) {
+		atomic.AddInt32(&calls, 1)
+		cancel()
+		return []string{id}, nil
+	})
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected the lookups to stop once cancelled, got %d", n)
+	}
+	if res := results["d"]; res.Err != context.Canceled {
+		t.Errorf("expected d to be cancelled, got %+v", res)
+	}
+}
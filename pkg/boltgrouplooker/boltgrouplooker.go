@@ -0,0 +1,402 @@
+package boltgrouplooker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/cachestats"
+	bolt "go.etcd.io/bbolt"
+	"sync/atomic"
+	"time"
+)
+
+var bucket = []byte("cache")
+
+// entry is the value stored in BoltDB for every key.
+// Expires is a unix timestamp in nanoseconds.
+type entry struct {
+	Expires int64           `json:"expires"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// boltgrouplooker is a wrapper around any GroupLooker that will cache
+// results for a given TTL in a local BoltDB file, so no external cache server is needed
+// and the cache survives restarts.
+// It uses the same keys as redisgrouplooker (egroup:<gid>, u:<uid>, ...).
+func New(path string, ttl int, wrapped pkg.GroupLooker) (pkg.GroupLooker, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	gl := &groupLooker{
+		ttl:     int64(ttl),
+		db:      db,
+		wrapped: wrapped,
+		stats:   cachestats.New(),
+		done:    make(chan struct{}),
+		now:     time.Now,
+	}
+
+	// remove what expired while we were not running and keep removing it
+	// periodically, else keys that are never queried again would stay forever
+	gl.purge()
+	interval := gl.expiration()
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	go gl.janitor(interval)
+	return gl, nil
+}
+
+type groupLooker struct {
+	ttl     int64
+	db      *bolt.DB
+	wrapped pkg.GroupLooker
+	stats   *cachestats.Stats
+	done    chan struct{}
+	now     func() time.Time
+}
+
+// Stats returns the hit/miss counters of the cache.
+func (gl *groupLooker) Stats() *cachestats.Stats {
+	return gl.stats
+}
+
+// SetTTL changes the TTL of the entries cached from now on, the existing ones keep theirs.
+func (gl *groupLooker) SetTTL(ttl int) {
+	atomic.StoreInt64(&gl.ttl, int64(ttl))
+}
+
+func (gl *groupLooker) expiration() time.Duration {
+	return time.Second * time.Duration(atomic.LoadInt64(&gl.ttl))
+}
+
+// Close stops the janitor and closes the BoltDB file, releasing its lock.
+func (gl *groupLooker) Close() error {
+	close(gl.done)
+	return gl.db.Close()
+}
+
+func (gl *groupLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	key := fmt.Sprintf("egroup:%s", gid)
+
+	if cached {
+		uids := []string{}
+		if gl.load(cachestats.KindGroup, key, &uids) {
+			return uids, nil
+		}
+	} else {
+		gl.stats.Refresh(cachestats.KindGroup)
+	}
+
+	start := time.Now()
+	uids, err := gl.wrapped.GetUsersInGroup(ctx, gid, false)
+	gl.stats.ObserveLDAP(cachestats.KindGroup, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gl.store(cachestats.KindGroup, key, uids); err != nil {
+		return nil, err
+	}
+	return uids, nil
+}
+
+func (gl *groupLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	key := fmt.Sprintf("unixgroup:%s", gid)
+
+	if cached {
+		uids := []string{}
+		if gl.load(cachestats.KindComputingGroup, key, &uids) {
+			return uids, nil
+		}
+	} else {
+		gl.stats.Refresh(cachestats.KindComputingGroup)
+	}
+
+	start := time.Now()
+	uids, err := gl.wrapped.GetUsersInComputingGroup(ctx, gid, false)
+	gl.stats.ObserveLDAP(cachestats.KindComputingGroup, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gl.store(cachestats.KindComputingGroup, key, uids); err != nil {
+		return nil, err
+	}
+	return uids, nil
+}
+
+func (gl *groupLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	key := fmt.Sprintf("u:%s", uid)
+
+	if cached {
+		gids := []string{}
+		if gl.load(cachestats.KindUser, key, &gids) {
+			return gids, nil
+		}
+	} else {
+		gl.stats.Refresh(cachestats.KindUser)
+	}
+
+	start := time.Now()
+	gids, err := gl.wrapped.GetUserGroups(ctx, uid, false)
+	gl.stats.ObserveLDAP(cachestats.KindUser, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gl.store(cachestats.KindUser, key, gids); err != nil {
+		return nil, err
+	}
+	return gids, nil
+}
+
+func (gl *groupLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	key := fmt.Sprintf("unixuser:%s", uid)
+
+	if cached {
+		gids := []string{}
+		if gl.load(cachestats.KindComputingUser, key, &gids) {
+			return gids, nil
+		}
+	} else {
+		gl.stats.Refresh(cachestats.KindComputingUser)
+	}
+
+	start := time.Now()
+	gids, err := gl.wrapped.GetUserComputingGroups(ctx, uid, false)
+	gl.stats.ObserveLDAP(cachestats.KindComputingUser, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gl.store(cachestats.KindComputingUser, key, gids); err != nil {
+		return nil, err
+	}
+	return gids, nil
+}
+
+func (gl *groupLooker) Search(ctx context.Context, filter string, cached bool) ([]*pkg.SearchEntry, error) {
+	key := fmt.Sprintf("filter:%s", filter)
+
+	if cached {
+		entries := []*pkg.SearchEntry{}
+		if gl.load(cachestats.KindSearch, key, &entries) {
+			return entries, nil
+		}
+	} else {
+		gl.stats.Refresh(cachestats.KindSearch)
+	}
+
+	start := time.Now()
+	entries, err := gl.wrapped.Search(ctx, filter, false)
+	gl.stats.ObserveLDAP(cachestats.KindSearch, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gl.store(cachestats.KindSearch, key, entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (gl *groupLooker) GetTTLForUser(ctx context.Context, uid string) (time.Duration, error) {
+	key := fmt.Sprintf("u:%s", uid)
+	return gl.getTTL(key)
+}
+
+func (gl *groupLooker) GetTTLForGroup(ctx context.Context, gid string) (time.Duration, error) {
+	key := fmt.Sprintf("egroup:%s", gid)
+	return gl.getTTL(key)
+}
+
+func (gl *groupLooker) GetTTLForComputingGroup(ctx context.Context, gid string) (time.Duration, error) {
+	key := fmt.Sprintf("unixgroup:%s", gid)
+	return gl.getTTL(key)
+}
+
+func (gl *groupLooker) GetTTLForComputingUser(ctx context.Context, uid string) (time.Duration, error) {
+	key := fmt.Sprintf("unixuser:%s", uid)
+	return gl.getTTL(key)
+}
+
+// IsUserInGroup answers from the members of gid stored in the bucket or, else, the groups
+// of uid, both include the nested groups. If neither is stored it asks the wrapped GroupLooker
+// and does not store the answer.
+func (gl *groupLooker) IsUserInGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	return gl.isMember(ctx, fmt.Sprintf("egroup:%s", gid), uid, fmt.Sprintf("u:%s", uid), gid, cached, gl.wrapped.IsUserInGroup)
+}
+
+// IsUserInComputingGroup answers only from the stored members of gid, the stored computing
+// groups of uid miss the groups it is in through a nested group.
+func (gl *groupLooker) IsUserInComputingGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	return gl.isMember(ctx, fmt.Sprintf("unixgroup:%s", gid), uid, "", gid, cached, gl.wrapped.IsUserInComputingGroup)
+}
+
+// isMember decodes the stored lists without counting them as lookups of the lists,
+// an empty userKey is not read.
+func (gl *groupLooker) isMember(ctx context.Context, groupKey, uid, userKey, gid string, cached bool,
+	lookup func(ctx context.Context, uid, gid string, cached bool) (bool, error)) (bool, error) {
+	if cached {
+		uids := []string{}
+		if gl.peek(groupKey, &uids) {
+			gl.stats.Hit(cachestats.KindMembership)
+			return pkg.Contains(uids, uid), nil
+		}
+		gids := []string{}
+		if userKey != "" && gl.peek(userKey, &gids) {
+			gl.stats.Hit(cachestats.KindMembership)
+			return pkg.Contains(gids, gid), nil
+		}
+		gl.stats.Miss(cachestats.KindMembership)
+	} else {
+		gl.stats.Refresh(cachestats.KindMembership)
+	}
+
+	start := time.Now()
+	ok, err := lookup(ctx, uid, gid, false)
+	gl.stats.ObserveLDAP(cachestats.KindMembership, time.Since(start))
+	return ok, err
+}
+
+// load decodes the cached value for key into v and counts the lookup as a hit, a miss
+// or a stale hit.
+// It returns false if the key is not cached, has expired or cannot be decoded.
+func (gl *groupLooker) load(kind cachestats.Kind, key string, v interface{}) bool {
+	e, err := gl.get(key)
+	if err != nil || e == nil {
+		gl.stats.Miss(kind)
+		return false
+	}
+	if gl.now().UnixNano() >= e.Expires {
+		gl.stats.StaleHit(kind)
+		return false
+	}
+	if err := json.Unmarshal(e.Data, v); err != nil {
+		gl.stats.Miss(kind)
+		return false
+	}
+	gl.stats.Hit(kind)
+	return true
+}
+
+// peek decodes the cached value for key into v like load, without counting the lookup.
+func (gl *groupLooker) peek(key string, v interface{}) bool {
+	e, err := gl.get(key)
+	if err != nil || e == nil || gl.now().UnixNano() >= e.Expires {
+		return false
+	}
+	return json.Unmarshal(e.Data, v) == nil
+}
+
+// store saves v under key with the configured TTL.
+func (gl *groupLooker) store(kind cachestats.Kind, key string, v interface{}) error {
+	err := gl.put(key, v)
+	if err != nil {
+		gl.stats.WriteFailure(kind)
+	}
+	return err
+}
+
+func (gl *groupLooker) put(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e := &entry{
+		Expires: gl.now().Add(gl.expiration()).UnixNano(),
+		Data:    data,
+	}
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return gl.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), value)
+	})
+}
+
+func (gl *groupLooker) get(key string) (*entry, error) {
+	var e *entry
+	err := gl.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(bucket).Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+		e = &entry{}
+		return json.Unmarshal(value, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// getTTL mimics the Redis TTL command: -2s is returned when the key does not exist
+// or has already expired.
+func (gl *groupLooker) getTTL(key string) (time.Duration, error) {
+	e, err := gl.get(key)
+	if err != nil {
+		return 0, err
+	}
+	if e == nil {
+		return time.Duration(-2) * time.Second, nil
+	}
+	ttl := time.Duration(e.Expires - gl.now().UnixNano())
+	if ttl <= 0 {
+		return time.Duration(-2) * time.Second, nil
+	}
+	return ttl, nil
+}
+
+// purge removes all the expired entries.
+func (gl *groupLooker) purge() error {
+	now := gl.now().UnixNano()
+	return gl.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+
+		// deleting while iterating with a cursor skips keys, so collect them first
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			e := &entry{}
+			if err := json.Unmarshal(v, e); err != nil || now >= e.Expires {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// janitor purges the expired entries every interval until Close.
+func (gl *groupLooker) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			gl.purge()
+		case <-gl.done:
+			return
+		}
+	}
+}
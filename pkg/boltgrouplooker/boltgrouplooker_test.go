@@ -0,0 +1,267 @@
+package boltgrouplooker
+
+import (
+	"context"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/cachestats"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeLooker struct {
+	calls int
+}
+
+func (f *fakeLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"hugo", "labkode"}, nil
+}
+func (f *fakeLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"cernbox-admins"}, nil
+}
+func (f *fakeLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"hugo"}, nil
+}
+func (f *fakeLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"zp"}, nil
+}
+func (f *fakeLooker) GetTTLForUser(ctx context.Context, uid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) GetTTLForGroup(ctx context.Context, gid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) GetTTLForComputingUser(ctx context.Context, uid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) GetTTLForComputingGroup(ctx context.Context, gid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) Search(ctx context.Context, filter string, cached bool) ([]*pkg.SearchEntry, error) {
+	f.calls++
+	return []*pkg.SearchEntry{{CN: filter}}, nil
+}
+
+func (f *fakeLooker) IsUserInGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	f.calls++
+	return uid == "hugo", nil
+}
+func (f *fakeLooker) IsUserInComputingGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	f.calls++
+	return uid == "hugo", nil
+}
+
+// newTestLooker opens a cache in a temporary directory with its clock stopped at now,
+// close removes it.
+func newTestLooker(t *testing.T, ttl int) (gl *groupLooker, fake *fakeLooker, now *time.Time, close func()) {
+	dir, err := ioutil.TempDir("", "boltgrouplooker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake = &fakeLooker{}
+	looker, err := New(filepath.Join(dir, "cache.db"), ttl, fake)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	gl = looker.(*groupLooker)
+	now = new(time.Time)
+	*now = time.Now()
+	gl.now = func() time.Time { return *now }
+	return gl, fake, now, func() {
+		gl.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	ctx := context.Background()
+	gl, fake, _, close := newTestLooker(t, 60)
+	defer close()
+
+	for i := 0; i < 3; i++ {
+		uids, err := gl.GetUsersInGroup(ctx, "cernbox-admins", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(uids) != 2 {
+			t.Fatalf("expected 2 uids, got %v", uids)
+		}
+	}
+	if fake.calls != 1 {
+		t.Errorf("expected 1 call to the wrapped looker, got %d", fake.calls)
+	}
+
+	// not cached lookups always go to the wrapped looker
+	gl.GetUsersInGroup(ctx, "cernbox-admins", false)
+	if fake.calls != 2 {
+		t.Errorf("expected 2 calls to the wrapped looker, got %d", fake.calls)
+	}
+
+	stats := gl.Stats().Snapshot().Kinds[cachestats.KindGroup]
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Refreshes != 1 || stats.LDAPLookups != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	ctx := context.Background()
+	gl, fake, now, close := newTestLooker(t, 60)
+	defer close()
+
+	gl.GetUserGroups(ctx, "hugo", true)
+	ttl, _ := gl.GetTTLForUser(ctx, "hugo")
+	if ttl != 60*time.Second {
+		t.Errorf("expected ttl of 60s, got %s", ttl)
+	}
+
+	*now = now.Add(61 * time.Second)
+	ttl, _ = gl.GetTTLForUser(ctx, "hugo")
+	if ttl != -2*time.Second {
+		t.Errorf("expected ttl of -2s for expired entry, got %s", ttl)
+	}
+
+	gl.GetUserGroups(ctx, "hugo", true)
+	if fake.calls != 2 {
+		t.Errorf("expected expired entry to be refreshed, got %d calls", fake.calls)
+	}
+	if stale := gl.Stats().Snapshot().Kinds[cachestats.KindUser].StaleHits; stale != 1 {
+		t.Errorf("expected 1 stale hit, got %d", stale)
+	}
+
+	// a new TTL applies to the entries stored from now on
+	gl.SetTTL(10)
+	gl.GetUserComputingGroups(ctx, "hugo", true)
+	if ttl, _ := gl.GetTTLForComputingUser(ctx, "hugo"); ttl != 10*time.Second {
+		t.Errorf("expected ttl of 10s, got %s", ttl)
+	}
+	if ttl, _ := gl.GetTTLForUser(ctx, "hugo"); ttl != 60*time.Second {
+		t.Errorf("expected the stored entry to keep its ttl of 60s, got %s", ttl)
+	}
+
+	*now = now.Add(11 * time.Second)
+	if err := gl.purge(); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := gl.get("unixuser:hugo"); e != nil {
+		t.Error("expected the expired entry to be purged")
+	}
+	if e, _ := gl.get("u:hugo"); e == nil {
+		t.Error("expected the valid entry to be kept")
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	ctx := context.Background()
+	gl, _, now, close := newTestLooker(t, 60)
+	defer close()
+
+	gl.Search(ctx, "hugo", true)
+	*now = now.Add(61 * time.Second)
+	go gl.janitor(10 * time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e, err := gl.get("filter:hugo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the janitor to purge the expired entry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPurgeAtOpen checks that what expired while cboxgroupd was not running is removed
+// when the file is opened again, the janitor only runs every TTL.
+func TestPurgeAtOpen(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "boltgrouplooker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.db")
+
+	looker, err := New(path, 60, &fakeLooker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gl := looker.(*groupLooker)
+	gl.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	gl.GetUsersInGroup(ctx, "cernbox-admins", true)
+	gl.now = time.Now
+	gl.GetUserGroups(ctx, "hugo", true)
+	gl.Close()
+
+	looker, err = New(path, 60, &fakeLooker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gl = looker.(*groupLooker)
+	defer gl.Close()
+	if e, _ := gl.get("egroup:cernbox-admins"); e != nil {
+		t.Error("expected the expired entry to be purged at open")
+	}
+	if e, _ := gl.get("u:hugo"); e == nil {
+		t.Error("expected the valid entry to survive the restart")
+	}
+}
+
+func TestIsMember(t *testing.T) {
+	ctx := context.Background()
+	gl, fake, _, close := newTestLooker(t, 60)
+	defer close()
+
+	// nothing stored, asked to the wrapped looker without storing the answer
+	for i := 0; i < 2; i++ {
+		if ok, _ := gl.IsUserInGroup(ctx, "hugo", "cernbox-admins", true); !ok {
+			t.Error("expected hugo to be a member")
+		}
+	}
+	if fake.calls != 2 {
+		t.Errorf("expected 2 calls to the wrapped looker, got %d", fake.calls)
+	}
+
+	// answered from the stored members of the group, then from the stored groups of the user
+	gl.GetUsersInGroup(ctx, "cernbox-admins", true)
+	if ok, _ := gl.IsUserInGroup(ctx, "labkode", "cernbox-admins", true); !ok {
+		t.Error("expected labkode to be a member")
+	}
+	gl.GetUserGroups(ctx, "labkode", true)
+	if ok, _ := gl.IsUserInGroup(ctx, "labkode", "it-dep", true); ok {
+		t.Error("expected labkode not to be in it-dep")
+	}
+	if fake.calls != 4 {
+		t.Errorf("expected stored answers, got %d calls", fake.calls)
+	}
+
+	// the stored computing groups of the user are only the direct ones, the wrapped looker is asked
+	gl.GetUserComputingGroups(ctx, "labkode", true)
+	gl.IsUserInComputingGroup(ctx, "labkode", "zp", true)
+	if fake.calls != 6 {
+		t.Errorf("expected the wrapped looker to be asked, got %d calls", fake.calls)
+	}
+	gl.GetUsersInComputingGroup(ctx, "zp", true)
+	if ok, _ := gl.IsUserInComputingGroup(ctx, "hugo", "zp", true); !ok {
+		t.Error("expected hugo to be in zp")
+	}
+	if fake.calls != 7 {
+		t.Errorf("expected a stored answer, got %d calls", fake.calls)
+	}
+
+	stats := gl.Stats().Snapshot().Kinds[cachestats.KindMembership]
+	if stats.Hits != 3 || stats.Misses != 3 || stats.LDAPLookups != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,163 @@
+package cachestats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind is the kind of lookup the counters refer to.
+type Kind string
+
+var (
+	KindGroup          Kind = "group"
+	KindUser           Kind = "user"
+	KindComputingGroup Kind = "computinggroup"
+	KindComputingUser  Kind = "computinguser"
+	KindSearch         Kind = "search"
+	KindMembership     Kind = "membership"
+)
+
+var kinds = []Kind{KindGroup, KindUser, KindComputingGroup, KindComputingUser, KindSearch, KindMembership}
+
+// Reporter is implemented by the cache layers that keep statistics.
+type Reporter interface {
+	Stats() *Stats
+}
+
+// Counters are the statistics kept for every kind of lookup.
+// A lookup with cached=true is counted as a hit, a miss or a stale hit (the entry was
+// still in the cache but had expired, only for backends that do not expire entries
+// by themselves like bolt or memory).
+// A lookup with cached=false is counted as a refresh.
+type Counters struct {
+	Hits           uint64  `json:"hits"`
+	Misses         uint64  `json:"misses"`
+	StaleHits      uint64  `json:"stale_hits"`
+	Refreshes      uint64  `json:"refreshes"`
+	WriteFailures  uint64  `json:"write_failures"`
+	HitRatio       float64 `json:"hit_ratio"`
+	LDAPLookups    uint64  `json:"ldap_lookups"`
+	LDAPLatencyAvg float64 `json:"ldap_latency_avg_ms"`
+	LDAPLatencyMax float64 `json:"ldap_latency_max_ms"`
+}
+
+// Snapshot is a copy of the statistics at a given moment.
+type Snapshot struct {
+	Since time.Time         `json:"since"`
+	Kinds map[Kind]Counters `json:"kinds"`
+}
+
+type counters struct {
+	hits          uint64
+	misses        uint64
+	staleHits     uint64
+	refreshes     uint64
+	writeFailures uint64
+	ldapLookups   uint64
+	ldapLatency   uint64 // nanoseconds
+	ldapMax       uint64 // nanoseconds
+}
+
+// Stats keeps the counters of a cache layer, it is safe for concurrent use.
+type Stats struct {
+	counters map[Kind]*counters
+
+	mu    sync.Mutex
+	since time.Time
+}
+
+func New() *Stats {
+	s := &Stats{counters: map[Kind]*counters{}, since: time.Now()}
+	for _, k := range kinds {
+		s.counters[k] = &counters{}
+	}
+	return s
+}
+
+func (s *Stats) Hit(k Kind) {
+	atomic.AddUint64(&s.counters[k].hits, 1)
+}
+
+func (s *Stats) Miss(k Kind) {
+	atomic.AddUint64(&s.counters[k].misses, 1)
+}
+
+func (s *Stats) StaleHit(k Kind) {
+	atomic.AddUint64(&s.counters[k].staleHits, 1)
+}
+
+func (s *Stats) Refresh(k Kind) {
+	atomic.AddUint64(&s.counters[k].refreshes, 1)
+}
+
+func (s *Stats) WriteFailure(k Kind) {
+	atomic.AddUint64(&s.counters[k].writeFailures, 1)
+}
+
+// ObserveLDAP records the time spent by the wrapped GroupLooker to answer a lookup.
+func (s *Stats) ObserveLDAP(k Kind, d time.Duration) {
+	c := s.counters[k]
+	atomic.AddUint64(&c.ldapLookups, 1)
+	atomic.AddUint64(&c.ldapLatency, uint64(d))
+	for {
+		max := atomic.LoadUint64(&c.ldapMax)
+		if uint64(d) <= max || atomic.CompareAndSwapUint64(&c.ldapMax, max, uint64(d)) {
+			return
+		}
+	}
+}
+
+// Snapshot returns the current value of the counters.
+func (s *Stats) Snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot()
+}
+
+// Reset sets all the counters to zero and returns their values before the reset.
+func (s *Stats) Reset() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := s.snapshot()
+	for _, c := range s.counters {
+		atomic.StoreUint64(&c.hits, 0)
+		atomic.StoreUint64(&c.misses, 0)
+		atomic.StoreUint64(&c.staleHits, 0)
+		atomic.StoreUint64(&c.refreshes, 0)
+		atomic.StoreUint64(&c.writeFailures, 0)
+		atomic.StoreUint64(&c.ldapLookups, 0)
+		atomic.StoreUint64(&c.ldapLatency, 0)
+		atomic.StoreUint64(&c.ldapMax, 0)
+	}
+	s.since = time.Now()
+	return snap
+}
+
+func (s *Stats) snapshot() Snapshot {
+	snap := Snapshot{Since: s.since, Kinds: map[Kind]Counters{}}
+	for k, c := range s.counters {
+		cs := Counters{
+			Hits:          atomic.LoadUint64(&c.hits),
+			Misses:        atomic.LoadUint64(&c.misses),
+			StaleHits:     atomic.LoadUint64(&c.staleHits),
+			Refreshes:     atomic.LoadUint64(&c.refreshes),
+			WriteFailures: atomic.LoadUint64(&c.writeFailures),
+			LDAPLookups:   atomic.LoadUint64(&c.ldapLookups),
+		}
+		if lookups := cs.Hits + cs.Misses + cs.StaleHits; lookups > 0 {
+			cs.HitRatio = float64(cs.Hits) / float64(lookups)
+		}
+		if cs.LDAPLookups > 0 {
+			cs.LDAPLatencyAvg = toMilliseconds(atomic.LoadUint64(&c.ldapLatency) / cs.LDAPLookups)
+			cs.LDAPLatencyMax = toMilliseconds(atomic.LoadUint64(&c.ldapMax))
+		}
+		snap.Kinds[k] = cs
+	}
+	return snap
+}
+
+func toMilliseconds(ns uint64) float64 {
+	return float64(ns) / float64(time.Millisecond)
+}
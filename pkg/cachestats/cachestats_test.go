@@ -0,0 +1,63 @@
+package cachestats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounters(t *testing.T) {
+	s := New()
+	s.Hit(KindGroup)
+	s.Hit(KindGroup)
+	s.Hit(KindGroup)
+	s.Miss(KindGroup)
+	s.StaleHit(KindUser)
+	s.Refresh(KindUser)
+	s.WriteFailure(KindSearch)
+	s.ObserveLDAP(KindGroup, 10*time.Millisecond)
+	s.ObserveLDAP(KindGroup, 30*time.Millisecond)
+
+	snap := s.Snapshot()
+	group := snap.Kinds[KindGroup]
+	if group.Hits != 3 || group.Misses != 1 || group.HitRatio != 0.75 {
+		t.Errorf("unexpected group counters: %+v", group)
+	}
+	if group.LDAPLookups != 2 || group.LDAPLatencyAvg != 20 || group.LDAPLatencyMax != 30 {
+		t.Errorf("unexpected LDAP latency: %+v", group)
+	}
+	user := snap.Kinds[KindUser]
+	if user.StaleHits != 1 || user.Refreshes != 1 || user.HitRatio != 0 {
+		t.Errorf("unexpected user counters: %+v", user)
+	}
+	if failures := snap.Kinds[KindSearch].WriteFailures; failures != 1 {
+		t.Errorf("expected 1 write failure, got %d", failures)
+	}
+	if len(snap.Kinds) != len(kinds) {
+		t.Errorf("expected counters for the %d kinds, got %d", len(kinds), len(snap.Kinds))
+	}
+}
+
+func TestReset(t *testing.T) {
+	s := New()
+	since := s.Snapshot().Since
+	s.Hit(KindMembership)
+	s.Miss(KindMembership)
+	s.ObserveLDAP(KindMembership, time.Millisecond)
+
+	// the values before the reset are returned
+	before := s.Reset()
+	if c := before.Kinds[KindMembership]; c.Hits != 1 || c.Misses != 1 || c.LDAPLookups != 1 {
+		t.Errorf("unexpected counters before the reset: %+v", c)
+	}
+	if !before.Since.Equal(since) {
+		t.Errorf("expected the snapshot since %s, got %s", since, before.Since)
+	}
+
+	after := s.Snapshot()
+	if c := after.Kinds[KindMembership]; c != (Counters{}) {
+		t.Errorf("expected zero counters after the reset, got %+v", c)
+	}
+	if after.Since.Before(before.Since) {
+		t.Errorf("expected since to move forward, got %s", after.Since)
+	}
+}
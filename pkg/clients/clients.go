@@ -0,0 +1,144 @@
+package clients
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownSecret is returned by Authenticate when no client has the secret.
+	ErrUnknownSecret = errors.New("unknown secret")
+	// ErrExpiredSecret is returned by Authenticate when the secret of a client has expired.
+	ErrExpiredSecret = errors.New("expired secret")
+)
+
+// Secret is one of the secrets of a client. Either the secret itself or its
+// SHA-256 hash, written as sha256:<hex>, is configured.
+// A zero Expires means the secret does not expire.
+type Secret struct {
+	Secret  string
+	Hash    string
+	Expires time.Time
+}
+
+// Client is a consumer of the API. It can have several valid secrets at the
+// same time so that they can be rotated without downtime.
+type Client struct {
+	Name    string
+	Secrets []Secret
+}
+
+type entry struct {
+	client  string
+	digest  []byte
+	expires time.Time
+}
+
+// Registry authenticates the clients by their secret.
+// The secrets are only kept hashed in memory.
+type Registry struct {
+	mu      sync.RWMutex
+	entries []entry
+	now     func() time.Time
+}
+
+// New returns a Registry with the given clients.
+func New(clients []Client) (*Registry, error) {
+	r := &Registry{now: time.Now}
+	if err := r.Set(clients); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Set replaces the clients. If any of them is invalid the previous ones are kept.
+func (r *Registry) Set(clients []Client) error {
+	var entries []entry
+	seen := map[string]bool{}
+	owners := map[string]string{}
+	for _, c := range clients {
+		if c.Name == "" {
+			return errors.New("client without name")
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("client %s is defined twice", c.Name)
+		}
+		seen[c.Name] = true
+		if len(c.Secrets) == 0 {
+			return fmt.Errorf("client %s has no secrets", c.Name)
+		}
+
+		for i, s := range c.Secrets {
+			digest, err := digestOf(s)
+			if err != nil {
+				return fmt.Errorf("secret %d of client %s: %s", i, c.Name, err)
+			}
+			// a secret names a single client, else the first one would get the requests of the other
+			if owner, ok := owners[string(digest)]; ok && owner != c.Name {
+				return fmt.Errorf("clients %s and %s have the same secret", owner, c.Name)
+			}
+			owners[string(digest)] = c.Name
+			entries = append(entries, entry{client: c.Name, digest: digest, expires: s.Expires})
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = entries
+	return nil
+}
+
+func digestOf(s Secret) ([]byte, error) {
+	switch {
+	case s.Secret != "" && s.Hash != "":
+		return nil, errors.New("both secret and hash are set")
+	case s.Secret != "":
+		sum := sha256.Sum256([]byte(s.Secret))
+		return sum[:], nil
+	case strings.HasPrefix(s.Hash, "sha256:"):
+		digest, err := hex.DecodeString(strings.TrimPrefix(s.Hash, "sha256:"))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, errors.New("invalid sha256 hash")
+		}
+		return digest, nil
+	case s.Hash != "":
+		return nil, errors.New("hash must be written as sha256:<hex>")
+	default:
+		return nil, errors.New("secret or hash must be set")
+	}
+}
+
+// Authenticate returns the name of the client that has the secret.
+// Every configured secret is compared in constant time.
+func (r *Registry) Authenticate(secret string) (string, error) {
+	sum := sha256.Sum256([]byte(secret))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := r.now()
+	var found *entry
+	for i := range r.entries {
+		e := &r.entries[i]
+		if subtle.ConstantTimeCompare(sum[:], e.digest) == 1 && (found == nil || found.expired(now)) {
+			found = e
+		}
+	}
+	if found == nil {
+		return "", ErrUnknownSecret
+	}
+	if found.expired(now) {
+		return found.client, ErrExpiredSecret
+	}
+	return found.client, nil
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
@@ -0,0 +1,77 @@
+package clients
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	r, err := New([]Client{
+		{Name: "web", Secrets: []Secret{
+			// sha256 of "old", expiring during the rotation
+			{Hash: "sha256:cba06b5736faf67e54b07b561eae94395e774c517a7d910a54369e1263ccfbd4", Expires: now.Add(-time.Hour)},
+			{Secret: "new"},
+		}},
+		{Name: "sync", Secrets: []Secret{{Hash: "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.now = func() time.Time { return now }
+
+	tests := []struct {
+		secret string
+		client string
+		err    error
+	}{
+		{"new", "web", nil},
+		{"old", "web", ErrExpiredSecret},
+		{"abc", "sync", nil},
+		{"ABC", "", ErrUnknownSecret},
+		{"", "", ErrUnknownSecret},
+	}
+	for _, test := range tests {
+		client, err := r.Authenticate(test.secret)
+		if client != test.client || err != test.err {
+			t.Errorf("%q: expected %q %v, got %q %v", test.secret, test.client, test.err, client, err)
+		}
+	}
+}
+
+func TestExpiredSecret(t *testing.T) {
+	r, err := New([]Client{{Name: "web", Secrets: []Secret{{Secret: "old", Expires: time.Now().Add(-time.Minute)}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client, err := r.Authenticate("old"); client != "web" || err != ErrExpiredSecret {
+		t.Errorf("expected expired secret of web, got %q %v", client, err)
+	}
+}
+
+func TestInvalidClients(t *testing.T) {
+	r, err := New([]Client{{Name: "web", Secrets: []Secret{{Secret: "s"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := [][]Client{
+		{{Name: "", Secrets: []Secret{{Secret: "s"}}}},
+		{{Name: "web"}},
+		{{Name: "web", Secrets: []Secret{{Hash: "md5:abc"}}}},
+		{{Name: "web", Secrets: []Secret{{Hash: "sha256:abc"}}}},
+		{{Name: "web", Secrets: []Secret{{Secret: "s"}}}, {Name: "web", Secrets: []Secret{{Secret: "t"}}}},
+		// sha256 of "abc", the same secret as sync
+		{{Name: "web", Secrets: []Secret{{Hash: "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}}}, {Name: "sync", Secrets: []Secret{{Secret: "abc"}}}},
+	}
+	for _, clients := range invalid {
+		if err := r.Set(clients); err == nil {
+			t.Errorf("expected error for %+v", clients)
+		}
+	}
+
+	// the previous clients are kept
+	if client, err := r.Authenticate("s"); client != "web" || err != nil {
+		t.Errorf("expected previous clients to be kept, got %q %v", client, err)
+	}
+}
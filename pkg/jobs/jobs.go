@@ -0,0 +1,112 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when the job does not exist or has expired.
+var ErrNotFound = errors.New("job not found")
+
+// Kinds of jobs, one per update route.
+const (
+	KindUsersInGroup          = "usersingroup"
+	KindUserGroups            = "usergroups"
+	KindUsersInComputingGroup = "usersincomputinggroup"
+	KindUserComputingGroups   = "usercomputinggroups"
+	KindSearch                = "search"
+)
+
+type Status string
+
+var (
+	StatusRunning  Status = "running"
+	StatusFinished Status = "finished"
+)
+
+type ItemStatus string
+
+var (
+	ItemStatusPending  ItemStatus = "pending"
+	ItemStatusDone     ItemStatus = "done"
+	ItemStatusNotFound ItemStatus = "notfound"
+	ItemStatusFailed   ItemStatus = "failed"
+)
+
+// Item is the result of the refresh of one group or user of a job.
+type Item struct {
+	ID      string     `json:"id"`
+	Status  ItemStatus `json:"status"`
+	Members int        `json:"members"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// Job tracks an asynchronous refresh of the cache.
+// Done counts the items already processed, Failed the ones among them that could not be refreshed.
+type Job struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     Status     `json:"status"`
+	Total      int        `json:"total"`
+	Done       int        `json:"done"`
+	Failed     int        `json:"failed"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Items      []*Item    `json:"items"`
+}
+
+// Pending is an item of the queue interrupted at shutdown, with the jobs waiting for it.
+// It is saved in the store so that the next start resumes it.
+type Pending struct {
+	Kind string   `json:"kind"`
+	ID   string   `json:"id"`
+	Jobs []string `json:"jobs"`
+}
+
+// Store keeps the state of the jobs.
+// Implementations must be safe for concurrent use as the items of a job are
+// processed in parallel.
+type Store interface {
+	Create(ctx context.Context, job *Job) error
+	SetItem(ctx context.Context, id string, item *Item) error
+	Finish(ctx context.Context, id string) error
+	Get(ctx context.Context, id string) (*Job, error)
+	// SavePending appends items interrupted at shutdown.
+	SavePending(ctx context.Context, pending []*Pending) error
+	// TakePending returns and removes the saved items.
+	TakePending(ctx context.Context) ([]*Pending, error)
+	Close() error
+}
+
+// New returns a running job with all the given ids pending.
+// Duplicated and empty ids are ignored.
+func New(kind string, ids []string) *Job {
+	job := &Job{
+		ID:        newID(),
+		Kind:      kind,
+		Status:    StatusRunning,
+		CreatedAt: time.Now().UTC(),
+		Items:     []*Item{},
+	}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		job.Items = append(job.Items, &Item{ID: id, Status: ItemStatusPending})
+	}
+	job.Total = len(job.Items)
+	return job
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
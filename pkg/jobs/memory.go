@@ -0,0 +1,117 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// NewMemoryStore returns a Store that keeps the jobs in memory, for the cache
+// backends that do not use Redis. Jobs are forgotten ttl seconds after their creation.
+// The pending items saved at shutdown are lost with the process, Close reports them.
+func NewMemoryStore(ttl int) Store {
+	return &memoryStore{jobs: map[string]*Job{}, ttl: time.Second * time.Duration(ttl)}
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	pending []*Pending
+	ttl     time.Duration
+}
+
+func (s *memoryStore) Create(ctx context.Context, job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// remove the expired jobs, this is the only place where the map grows
+	for id, j := range s.jobs {
+		if time.Since(j.CreatedAt) > s.ttl {
+			delete(s.jobs, id)
+		}
+	}
+	s.jobs[job.ID] = copyJob(job)
+	return nil
+}
+
+func (s *memoryStore) SetItem(ctx context.Context, id string, item *Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for i, it := range job.Items {
+		if it.ID == item.ID {
+			c := *item
+			job.Items[i] = &c
+			break
+		}
+	}
+	job.Done++
+	if item.Status == ItemStatusFailed {
+		job.Failed++
+	}
+	return nil
+}
+
+func (s *memoryStore) Finish(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	now := time.Now().UTC()
+	job.Status = StatusFinished
+	job.FinishedAt = &now
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok || time.Since(job.CreatedAt) > s.ttl {
+		return nil, ErrNotFound
+	}
+	return copyJob(job), nil
+}
+
+func (s *memoryStore) SavePending(ctx context.Context, pending []*Pending) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, pending...)
+	return nil
+}
+
+func (s *memoryStore) TakePending(ctx context.Context) ([]*Pending, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending
+	s.pending = nil
+	return pending, nil
+}
+
+func (s *memoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) > 0 {
+		return fmt.Errorf("%d update items not refreshed are dropped, the memory job store does not keep them across restarts", len(s.pending))
+	}
+	return nil
+}
+
+func copyJob(job *Job) *Job {
+	c := *job
+	c.Items = make([]*Item, len(job.Items))
+	for i, it := range job.Items {
+		item := *it
+		c.Items[i] = &item
+	}
+	return &c
+}
@@ -0,0 +1,46 @@
+package jobs
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(60)
+
+	job := New("usersingroup", []string{"cernbox-admins", "", "cernbox-admins", "it-dep"})
+	if job.Total != 2 {
+		t.Fatalf("expected 2 items, got %d", job.Total)
+	}
+	if err := store.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	store.SetItem(ctx, job.ID, &Item{ID: "cernbox-admins", Status: ItemStatusDone, Members: 3})
+	store.SetItem(ctx, job.ID, &Item{ID: "it-dep", Status: ItemStatusFailed, Error: "ldap down"})
+	store.Finish(ctx, job.ID)
+
+	got, err := store.Get(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusFinished || got.Done != 2 || got.Failed != 1 || got.FinishedAt == nil {
+		t.Errorf("unexpected job: %+v", got)
+	}
+	if got.Items[0].Members != 3 || got.Items[1].Error != "ldap down" {
+		t.Errorf("unexpected items: %+v %+v", got.Items[0], got.Items[1])
+	}
+
+	if _, err := store.Get(ctx, "nope"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Errorf("expected no error without pending items, got %v", err)
+	}
+	store.SavePending(ctx, []*Pending{{Kind: "usersingroup", ID: "it-dep", Jobs: []string{job.ID}}})
+	if err := store.Close(); err == nil {
+		t.Error("expected the dropped pending items to be reported")
+	}
+}
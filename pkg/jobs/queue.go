@@ -0,0 +1,441 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"github.com/cernbox/cboxgroupd/pkg/metrics"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// ErrShuttingDown is returned by Queue.Submit once Shutdown has been called.
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// ErrQueueFull is returned by Queue.Submit when there is no room for the items of a job.
+var ErrQueueFull = errors.New("update queue is full")
+
+// ErrJobTooLarge is returned by Queue.Submit for a job with more new items than the
+// queue can hold, it would never fit.
+var ErrJobTooLarge = errors.New("job larger than the update queue")
+
+// ProcessFunc refreshes one item of a job and returns its result.
+type ProcessFunc func(ctx context.Context, kind, id string) *Item
+
+// task is an item waiting in the queue. The same item requested by several
+// jobs while it is still waiting is only processed once and its result is
+// saved in all of them.
+type task struct {
+	kind     string
+	id       string
+	jobs     []string
+	deadline time.Time
+}
+
+// Queue is a bounded queue of items to refresh shared by all the update requests,
+// processed by a fixed number of workers so the load on LDAP does not depend on
+// the number of concurrent requests.
+// The workers use a context owned by the queue, not the one of the request that created the job,
+// and every item is cancelled if it has not been processed timeout after being queued.
+type Queue struct {
+	logger  *zap.Logger
+	store   Store
+	process ProcessFunc
+	workers int
+	size    int
+	timeout time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	tasks  chan *task
+	wg     sync.WaitGroup
+
+	mu          sync.Mutex
+	active      int
+	closed      bool
+	pending     map[string]*task
+	running     map[*task]bool
+	reserved    int
+	remaining   map[string]int
+	interrupted []*Pending
+	avg         time.Duration
+}
+
+// NewQueue starts workers goroutines that process the items submitted to the queue.
+// At most size items can be waiting at the same time.
+// A timeout of zero means no timeout.
+func NewQueue(logger *zap.Logger, store Store, process ProcessFunc, workers, size int, timeout time.Duration) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		logger:    logger,
+		store:     store,
+		process:   process,
+		workers:   workers,
+		size:      size,
+		timeout:   timeout,
+		ctx:       ctx,
+		cancel:    cancel,
+		tasks:     make(chan *task, size),
+		pending:   map[string]*task{},
+		running:   map[*task]bool{},
+		remaining: map[string]int{},
+	}
+	q.SetWorkers(workers)
+	return q
+}
+
+// SetWorkers changes the number of workers. When it is lowered the extra workers
+// stop as they finish an item.
+func (q *Queue) SetWorkers(workers int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.workers = workers
+	for q.active < q.workers {
+		q.active++
+		q.wg.Add(1)
+		go q.worker()
+	}
+}
+
+// SetTimeout changes the timeout of the items queued from now on.
+func (q *Queue) SetTimeout(timeout time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.timeout = timeout
+}
+
+// Submit saves the job in the store and queues its items.
+// Items already waiting in the queue are merged with the existing ones.
+// If the new items do not fit in the queue nothing is queued and ErrQueueFull is returned,
+// or ErrJobTooLarge if they would not fit even in the empty queue.
+// The room for the items is reserved while the job is saved, without holding the lock
+// of the queue during the round trip to the store. The items that were merged may have
+// been processed meanwhile, if they no longer fit the job is refused with ErrQueueFull
+// and the saved job is left to expire, nobody knows its id.
+func (q *Queue) Submit(ctx context.Context, job *Job) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return ErrShuttingDown
+	}
+	var added int
+	for _, item := range job.Items {
+		if _, ok := q.pending[taskKey(job.Kind, item.ID)]; !ok {
+			added++
+		}
+	}
+	if added > q.size {
+		q.mu.Unlock()
+		return ErrJobTooLarge
+	}
+	if len(q.pending)+q.reserved+added > q.size {
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	q.reserved += added
+	q.mu.Unlock()
+
+	err := q.store.Create(ctx, job)
+	if err == nil && job.Total == 0 {
+		err = q.store.Finish(ctx, job.ID)
+	}
+
+	q.mu.Lock()
+	q.reserved -= added
+	closed := q.closed
+	if err == nil && job.Total > 0 && !closed {
+		var missing int
+		for _, item := range job.Items {
+			if _, ok := q.pending[taskKey(job.Kind, item.ID)]; !ok {
+				missing++
+			}
+		}
+		if len(q.pending)+q.reserved+missing > q.size {
+			q.mu.Unlock()
+			return ErrQueueFull
+		}
+		for _, item := range job.Items {
+			q.enqueue(job.Kind, item.ID, []string{job.ID})
+		}
+		metrics.UpdateQueueLength.Set(float64(len(q.pending)))
+	}
+	q.mu.Unlock()
+	if err != nil || job.Total == 0 || !closed {
+		return err
+	}
+
+	// shut down while the job was saved, the next start resumes it
+	pending := make([]*Pending, len(job.Items))
+	for i, item := range job.Items {
+		pending[i] = &Pending{Kind: job.Kind, ID: item.ID, Jobs: []string{job.ID}}
+	}
+	return q.store.SavePending(context.Background(), pending)
+}
+
+// Size returns the number of items that can be waiting at the same time.
+func (q *Queue) Size() int {
+	return q.size
+}
+
+// Resume queues the items saved in the store by the Shutdown of a previous queue
+// and returns how many were queued. The items that do not fit in the queue are
+// saved again for the next start.
+func (q *Queue) Resume(ctx context.Context) (int, error) {
+	pending, err := q.store.TakePending(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	q.mu.Lock()
+	var resumed int
+	var left []*Pending
+	for _, p := range pending {
+		if q.closed || !q.enqueue(p.Kind, p.ID, p.Jobs) {
+			left = append(left, p)
+			continue
+		}
+		resumed++
+	}
+	metrics.UpdateQueueLength.Set(float64(len(q.pending)))
+	q.mu.Unlock()
+
+	if len(left) > 0 {
+		if err := q.store.SavePending(ctx, left); err != nil {
+			return resumed, err
+		}
+	}
+	return resumed, nil
+}
+
+// enqueue adds an item for the given jobs, or adds the jobs to the item if it is
+// already waiting, and returns false if there is no room for a new item.
+// It must be called with q.mu held. The channel has room for size tasks and every
+// task in it is pending, the send never waits for a worker while holding the lock.
+func (q *Queue) enqueue(kind, id string, jobs []string) bool {
+	key := taskKey(kind, id)
+	t, ok := q.pending[key]
+	if ok {
+		t.jobs = append(t.jobs, jobs...)
+	} else {
+		if len(q.pending)+q.reserved >= q.size {
+			return false
+		}
+		t = &task{kind: kind, id: id, jobs: jobs}
+		if q.timeout > 0 {
+			t.deadline = time.Now().Add(q.timeout)
+		}
+		select {
+		case q.tasks <- t:
+		default:
+			return false
+		}
+		q.pending[key] = t
+	}
+
+	for _, job := range jobs {
+		if q.remaining[job] == 0 {
+			metrics.UpdateJobsInFlight.Inc()
+		}
+		q.remaining[job]++
+	}
+	return true
+}
+
+// Len returns the number of items waiting to be processed.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Running returns the number of jobs that have not finished yet.
+func (q *Queue) Running() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.remaining)
+}
+
+// RetryAfter estimates how long it will take for the queue to have room again.
+func (q *Queue) RetryAfter() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	avg := q.avg
+	if avg == 0 {
+		avg = time.Second
+	}
+	workers := q.workers
+	if n := len(q.pending); n < workers {
+		workers = n
+	}
+	if workers == 0 {
+		return time.Second
+	}
+	d := time.Duration(len(q.pending)) * avg / time.Duration(workers)
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// shutdownGrace is how long Shutdown waits for the workers to return once their items are
+// cancelled. A worker stuck in an LDAP call that ignores the cancellation is left behind.
+var shutdownGrace = 5 * time.Second
+
+// Shutdown stops accepting new jobs and waits for the queued items to be processed.
+// If ctx is done before, the remaining items are cancelled and Shutdown waits at most
+// shutdownGrace for the workers to return. The items not refreshed, including the ones
+// of the workers still running, are then saved in the store, leaving their jobs running,
+// so that Resume picks them up at the next start.
+// It returns ctx.Err() if the items had to be cancelled.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.tasks)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		select {
+		case <-done:
+		case <-time.After(shutdownGrace):
+		}
+
+		// a worker returning after this point may still save its result, its item
+		// is then refreshed once more at the next start
+		q.mu.Lock()
+		interrupted := q.interrupted
+		for t := range q.running {
+			interrupted = append(interrupted, &Pending{Kind: t.kind, ID: t.id, Jobs: t.jobs})
+		}
+		for _, t := range q.pending {
+			interrupted = append(interrupted, &Pending{Kind: t.kind, ID: t.id, Jobs: t.jobs})
+		}
+		stuck := len(q.running)
+		q.interrupted = nil
+		q.mu.Unlock()
+
+		if stuck > 0 {
+			q.logger.Warn("update workers did not return after the shutdown timeout", zap.Int("workers", stuck))
+		}
+		if err := q.store.SavePending(context.Background(), interrupted); err != nil {
+			q.logger.Error("error saving interrupted update items", zap.Error(err), zap.Int("items", len(interrupted)))
+		} else {
+			q.logger.Info("interrupted update items saved", zap.Int("items", len(interrupted)))
+		}
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) worker() {
+	defer q.wg.Done()
+	for t := range q.tasks {
+		q.mu.Lock()
+		delete(q.pending, taskKey(t.kind, t.id))
+		q.running[t] = true
+		metrics.UpdateQueueLength.Set(float64(len(q.pending)))
+		q.mu.Unlock()
+
+		ctx, cancel := q.ctx, context.CancelFunc(func() {})
+		if !t.deadline.IsZero() {
+			ctx, cancel = context.WithDeadline(q.ctx, t.deadline)
+		}
+
+		var result *Item
+		start := time.Now()
+		if err := ctx.Err(); err != nil {
+			// cancelled or expired while waiting, do not bother LDAP
+			result = &Item{ID: t.id, Status: ItemStatusFailed, Error: err.Error()}
+		} else {
+			result = q.process(ctx, t.kind, t.id)
+			q.observe(time.Since(start))
+		}
+		cancel()
+
+		q.mu.Lock()
+		delete(q.running, t)
+		if q.ctx.Err() != nil && result.Status == ItemStatusFailed {
+			// interrupted by the shutdown, not a real failure
+			q.interrupted = append(q.interrupted, &Pending{Kind: t.kind, ID: t.id, Jobs: t.jobs})
+			q.mu.Unlock()
+			continue
+		}
+		q.mu.Unlock()
+		q.done(t, result)
+
+		if q.retire() {
+			return
+		}
+	}
+}
+
+// retire tells a worker to stop when there are more than needed after SetWorkers.
+// The last worker never retires while the queue is open, else nothing would process
+// the remaining items.
+func (q *Queue) retire() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.active > q.workers && q.active > 1 {
+		q.active--
+		return true
+	}
+	return false
+}
+
+// done saves the result of a task in all the jobs waiting for it and finishes the
+// jobs that have no items left. The context of the queue may be cancelled already,
+// the results must be saved anyway.
+func (q *Queue) done(t *task, result *Item) {
+	for _, id := range t.jobs {
+		if err := q.store.SetItem(context.Background(), id, result); err != nil {
+			q.logger.Error("async: error saving job progress", zap.Error(err), zap.String("job", id))
+		}
+
+		q.mu.Lock()
+		q.remaining[id]--
+		finished := q.remaining[id] == 0
+		if finished {
+			delete(q.remaining, id)
+			metrics.UpdateJobsInFlight.Dec()
+		}
+		q.mu.Unlock()
+
+		if finished {
+			if err := q.store.Finish(context.Background(), id); err != nil {
+				q.logger.Error("async: error finishing job", zap.Error(err), zap.String("job", id))
+				continue
+			}
+			q.logger.Info("async: job finished", zap.String("job", id), zap.String("kind", t.kind))
+		}
+	}
+}
+
+// observe keeps a moving average of the processing time of an item.
+func (q *Queue) observe(d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.avg == 0 {
+		q.avg = d
+		return
+	}
+	q.avg = (q.avg*9 + d) / 10
+}
+
+func taskKey(kind, id string) string {
+	return kind + ":" + id
+}
@@ -0,0 +1,311 @@
+package jobs
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueTimeout(t *testing.T) {
+	store := NewMemoryStore(60)
+	q := NewQueue(zap.NewNop(), store, func(ctx context.Context, kind, id string) *Item {
+		<-ctx.Done()
+		return &Item{ID: id, Status: ItemStatusFailed, Error: ctx.Err().Error()}
+	}, 1, 10, 20*time.Millisecond)
+
+	job := New(KindUsersInGroup, []string{"a"})
+	if err := q.Submit(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get(context.Background(), job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item := got.Items[0]; item.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("expected item to time out, got %+v", item)
+	}
+}
+
+func TestQueueShutdownWaits(t *testing.T) {
+	store := NewMemoryStore(60)
+	q := NewQueue(zap.NewNop(), store, func(ctx context.Context, kind, id string) *Item {
+		time.Sleep(20 * time.Millisecond)
+		return &Item{ID: id, Status: ItemStatusDone}
+	}, 1, 10, time.Minute)
+
+	job := New(KindUsersInGroup, []string{"a", "b"})
+	if err := q.Submit(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get(context.Background(), job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusFinished || got.Done != 2 {
+		t.Errorf("expected job to finish before shutdown returns, got %+v", got)
+	}
+	if err := q.Submit(context.Background(), New(KindUsersInGroup, []string{"c"})); err != ErrShuttingDown {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+}
+
+func TestQueueMergesDuplicates(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	store := NewMemoryStore(60)
+	q := NewQueue(zap.NewNop(), store, func(ctx context.Context, kind, id string) *Item {
+		<-release
+		atomic.AddInt32(&calls, 1)
+		return &Item{ID: id, Status: ItemStatusDone, Members: 3}
+	}, 1, 10, time.Minute)
+
+	// keep the worker busy so the next jobs stay in the queue
+	if err := q.Submit(context.Background(), New(KindUsersInGroup, []string{"busy"})); err != nil {
+		t.Fatal(err)
+	}
+	for q.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	first := New(KindUsersInGroup, []string{"a"})
+	second := New(KindUsersInGroup, []string{"a", "b"})
+	other := New(KindUserGroups, []string{"a"})
+	for _, job := range []*Job{first, second, other} {
+		if err := q.Submit(context.Background(), job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := q.Len(); n != 3 {
+		t.Errorf("expected 3 queued items, got %d", n)
+	}
+
+	close(release)
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("expected 4 refreshes, got %d", n)
+	}
+	for _, job := range []*Job{first, second, other} {
+		got, err := store.Get(context.Background(), job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != StatusFinished || got.Done != got.Total || got.Items[0].Members != 3 {
+			t.Errorf("expected finished job with results, got %+v", got)
+		}
+	}
+}
+
+func TestQueueSetWorkers(t *testing.T) {
+	var running, max int32
+	release := make(chan struct{})
+	store := NewMemoryStore(60)
+	q := NewQueue(zap.NewNop(), store, func(ctx context.Context, kind, id string) *Item {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+		return &Item{ID: id, Status: ItemStatusDone}
+	}, 1, 10, time.Minute)
+
+	q.SetWorkers(3)
+	if err := q.Submit(context.Background(), New(KindUsersInGroup, []string{"a", "b", "c", "d"})); err != nil {
+		t.Fatal(err)
+	}
+	for atomic.LoadInt32(&running) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m := atomic.LoadInt32(&max); m != 3 {
+		t.Errorf("expected 3 concurrent refreshes, got %d", m)
+	}
+}
+
+// slowStore takes its time to create the jobs, the queue must not be locked meanwhile
+type slowStore struct {
+	Store
+	created chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) Create(ctx context.Context, job *Job) error {
+	s.created <- struct{}{}
+	<-s.release
+	return s.Store.Create(ctx, job)
+}
+
+func TestQueueReservesRoom(t *testing.T) {
+	store := &slowStore{Store: NewMemoryStore(60), created: make(chan struct{}), release: make(chan struct{})}
+	q := NewQueue(zap.NewNop(), store, func(ctx context.Context, kind, id string) *Item {
+		return &Item{ID: id, Status: ItemStatusDone}
+	}, 0, 2, time.Minute)
+
+	if err := q.Submit(context.Background(), New(KindUsersInGroup, []string{"a", "b", "c"})); err != ErrJobTooLarge {
+		t.Errorf("expected ErrJobTooLarge, got %v", err)
+	}
+
+	errc := make(chan error)
+	go func() {
+		errc <- q.Submit(context.Background(), New(KindUsersInGroup, []string{"a", "b"}))
+	}()
+	<-store.created
+
+	// the queue answers while the first job is saved, and its room is taken
+	if n := q.Len(); n != 0 {
+		t.Errorf("expected nothing queued yet, got %d", n)
+	}
+	if err := q.Submit(context.Background(), New(KindUsersInGroup, []string{"c"})); err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+
+	close(store.release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Len(); n != 2 {
+		t.Errorf("expected 2 queued items, got %d", n)
+	}
+}
+
+// holdStore holds the creation of the next job after hold is set, until release is closed.
+type holdStore struct {
+	Store
+	hold    int32
+	held    chan struct{}
+	release chan struct{}
+}
+
+func (s *holdStore) Create(ctx context.Context, job *Job) error {
+	if atomic.CompareAndSwapInt32(&s.hold, 1, 0) {
+		close(s.held)
+		<-s.release
+	}
+	return s.Store.Create(ctx, job)
+}
+
+// TestQueueFullWhileMerged fills the queue while a job merged with a waiting item
+// is saved, the item is taken by a worker meanwhile and no longer fits.
+func TestQueueFullWhileMerged(t *testing.T) {
+	store := &holdStore{Store: NewMemoryStore(60), held: make(chan struct{}), release: make(chan struct{})}
+	started := make(chan string, 10)
+	proceed := make(chan struct{})
+	q := NewQueue(zap.NewNop(), store, func(ctx context.Context, kind, id string) *Item {
+		started <- id
+		<-proceed
+		return &Item{ID: id, Status: ItemStatusDone}
+	}, 1, 2, time.Minute)
+
+	submit := func(ids ...string) error {
+		return q.Submit(context.Background(), New(KindUsersInGroup, ids))
+	}
+	if err := submit("w"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := submit("x"); err != nil {
+		t.Fatal(err)
+	}
+
+	// merged with the waiting x, no room reserved
+	atomic.StoreInt32(&store.hold, 1)
+	merged := make(chan error, 1)
+	go func() {
+		merged <- submit("x")
+	}()
+	<-store.held
+	proceed <- struct{}{}
+	if id := <-started; id != "x" {
+		t.Fatalf("expected x to be taken, got %s", id)
+	}
+	if err := submit("y", "z"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(store.release)
+	select {
+	case err := <-merged:
+		if err != ErrQueueFull {
+			t.Errorf("expected ErrQueueFull, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queue is stuck")
+	}
+	if n := q.Len(); n != 2 {
+		t.Errorf("expected 2 queued items, got %d", n)
+	}
+
+	close(proceed)
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestQueueShutdownStuckWorker interrupts a worker ignoring the cancellation, like an
+// LDAP call blocked on the network: Shutdown must not wait for it and still save its item.
+func TestQueueShutdownStuckWorker(t *testing.T) {
+	grace := shutdownGrace
+	shutdownGrace = 10 * time.Millisecond
+	defer func() { shutdownGrace = grace }()
+
+	store := NewMemoryStore(60)
+	started := make(chan string, 10)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	q := NewQueue(zap.NewNop(), store, func(ctx context.Context, kind, id string) *Item {
+		started <- id
+		<-stuck
+		return &Item{ID: id, Status: ItemStatusFailed, Error: "stuck"}
+	}, 1, 10, time.Minute)
+
+	job := New(KindUsersInGroup, []string{"a", "b"})
+	if err := q.Submit(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	returned := make(chan error, 1)
+	go func() {
+		returned <- q.Shutdown(ctx)
+	}()
+	select {
+	case err := <-returned:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown waits for the stuck worker")
+	}
+
+	pending, err := store.TakePending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]bool{}
+	for _, p := range pending {
+		ids[p.ID] = true
+	}
+	if len(pending) != 2 || !ids["a"] || !ids["b"] {
+		t.Errorf("expected a and b to be saved, got %+v", pending)
+	}
+}
@@ -0,0 +1,199 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/redis.v5"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// NewRedisStore returns a Store that keeps the jobs in Redis, so any instance
+// of cboxgroupd can report the progress of a job started by another one.
+// Every job uses two keys that expire after ttl seconds:
+// job:<id> is a hash with the job fields and job:<id>:items a hash with one JSON encoded item per group or user.
+// The items interrupted at shutdown are kept in the list jobs:pending.
+func NewRedisStore(hostname string, port, db int, password string, ttl int) Store {
+	client := redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%d", hostname, port),
+		DB:       db,
+		Password: password,
+	})
+	return &redisStore{client: client, ttl: ttl}
+}
+
+type redisStore struct {
+	client *redis.Client
+	ttl    int
+}
+
+const pendingKey = "jobs:pending"
+
+func jobKey(id string) string {
+	return fmt.Sprintf("job:%s", id)
+}
+
+func itemsKey(id string) string {
+	return fmt.Sprintf("job:%s:items", id)
+}
+
+func (s *redisStore) Create(ctx context.Context, job *Job) error {
+	key := jobKey(job.ID)
+	pipeline := s.client.TxPipeline()
+	defer pipeline.Close()
+	pipeline.HSet(key, "kind", job.Kind)
+	pipeline.HSet(key, "status", string(job.Status))
+	pipeline.HSet(key, "total", job.Total)
+	pipeline.HSet(key, "done", job.Done)
+	pipeline.HSet(key, "failed", job.Failed)
+	pipeline.HSet(key, "created_at", job.CreatedAt.Format(time.RFC3339Nano))
+	for _, item := range job.Items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		pipeline.HSet(itemsKey(job.ID), item.ID, string(data))
+	}
+	pipeline.Expire(key, time.Second*time.Duration(s.ttl))
+	pipeline.Expire(itemsKey(job.ID), time.Second*time.Duration(s.ttl))
+	_, err := pipeline.Exec()
+	return err
+}
+
+// setItemScript saves the item ARGV[1], encoded as ARGV[2], in the items KEYS[2] of the
+// job KEYS[1] and counts it as done, and as failed if ARGV[3] is 1. An expired job is
+// not recreated without TTL, 0 is returned instead. The items get the TTL of the job,
+// they have none if the job was created without items.
+var setItemScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+redis.call("HINCRBY", KEYS[1], "done", 1)
+if ARGV[3] == "1" then
+	redis.call("HINCRBY", KEYS[1], "failed", 1)
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[2], ttl)
+end
+return 1
+`)
+
+// finishScript sets the status ARGV[1] and the end time ARGV[2] of the job KEYS[1],
+// unless it has expired, in which case 0 is returned.
+var finishScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HMSET", KEYS[1], "status", ARGV[1], "finished_at", ARGV[2])
+return 1
+`)
+
+func (s *redisStore) SetItem(ctx context.Context, id string, item *Item) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	failed := "0"
+	if item.Status == ItemStatusFailed {
+		failed = "1"
+	}
+	return s.run(setItemScript, []string{jobKey(id), itemsKey(id)}, item.ID, string(data), failed)
+}
+
+func (s *redisStore) Finish(ctx context.Context, id string) error {
+	return s.run(finishScript, []string{jobKey(id)}, string(StatusFinished), time.Now().UTC().Format(time.RFC3339Nano))
+}
+
+// run runs a script updating a job, it returns ErrNotFound if the job has expired.
+func (s *redisStore) run(script *redis.Script, keys []string, args ...interface{}) error {
+	reply, err := script.Run(s.client, keys, args...).Result()
+	if err != nil {
+		return err
+	}
+	if updated, _ := reply.(int64); updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *redisStore) Get(ctx context.Context, id string) (*Job, error) {
+	fields, err := s.client.HGetAll(jobKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrNotFound
+	}
+
+	job := &Job{ID: id, Kind: fields["kind"], Status: Status(fields["status"]), Items: []*Item{}}
+	job.Total, _ = strconv.Atoi(fields["total"])
+	job.Done, _ = strconv.Atoi(fields["done"])
+	job.Failed, _ = strconv.Atoi(fields["failed"])
+	job.CreatedAt, _ = time.Parse(time.RFC3339Nano, fields["created_at"])
+	if v, ok := fields["finished_at"]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			job.FinishedAt = &t
+		}
+	}
+
+	items, err := s.client.HGetAll(itemsKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range items {
+		item := &Item{}
+		if err := json.Unmarshal([]byte(v), item); err != nil {
+			return nil, err
+		}
+		job.Items = append(job.Items, item)
+	}
+	sort.Slice(job.Items, func(i, j int) bool { return job.Items[i].ID < job.Items[j].ID })
+	return job, nil
+}
+
+func (s *redisStore) SavePending(ctx context.Context, pending []*Pending) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	pipeline := s.client.TxPipeline()
+	defer pipeline.Close()
+	for _, p := range pending {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		pipeline.RPush(pendingKey, string(data))
+	}
+	// the jobs are gone after ttl, there is no point in resuming them later
+	pipeline.Expire(pendingKey, time.Second*time.Duration(s.ttl))
+	_, err := pipeline.Exec()
+	return err
+}
+
+func (s *redisStore) TakePending(ctx context.Context) ([]*Pending, error) {
+	pipeline := s.client.TxPipeline()
+	defer pipeline.Close()
+	lrange := pipeline.LRange(pendingKey, 0, -1)
+	pipeline.Del(pendingKey)
+	if _, err := pipeline.Exec(); err != nil {
+		return nil, err
+	}
+
+	pending := []*Pending{}
+	for _, v := range lrange.Val() {
+		p := &Pending{}
+		if err := json.Unmarshal([]byte(v), p); err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	return pending, nil
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,86 @@
+package jobs
+
+import (
+	"context"
+	"github.com/alicebob/miniredis"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRedisStore(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	port, _ := strconv.Atoi(s.Port())
+	store := NewRedisStore(s.Host(), port, 0, "", 60)
+	defer store.Close()
+	ctx := context.Background()
+
+	job := New(KindUsersInGroup, []string{"cernbox-admins", "it-dep"})
+	if err := store.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetItem(ctx, job.ID, &Item{ID: "cernbox-admins", Status: ItemStatusDone, Members: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetItem(ctx, job.ID, &Item{ID: "it-dep", Status: ItemStatusFailed, Error: "ldap down"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Finish(ctx, job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusFinished || got.Done != 2 || got.Failed != 1 || got.FinishedAt == nil {
+		t.Errorf("unexpected job: %+v", got)
+	}
+	if got.Items[0].Members != 3 || got.Items[1].Error != "ldap down" {
+		t.Errorf("unexpected items: %+v %+v", got.Items[0], got.Items[1])
+	}
+	for _, key := range []string{jobKey(job.ID), itemsKey(job.ID)} {
+		if ttl := s.TTL(key); ttl != 60*time.Second {
+			t.Errorf("expected %s to keep its TTL, got %v", key, ttl)
+		}
+	}
+}
+
+// TestRedisStoreExpired updates a job after it has expired, like a worker finishing
+// an item late: the keys must not come back without TTL.
+func TestRedisStoreExpired(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	port, _ := strconv.Atoi(s.Port())
+	store := NewRedisStore(s.Host(), port, 0, "", 60)
+	defer store.Close()
+	ctx := context.Background()
+
+	job := New(KindUserGroups, []string{"hugo"})
+	if err := store.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	s.FastForward(61 * time.Second)
+
+	if err := store.SetItem(ctx, job.ID, &Item{ID: "hugo", Status: ItemStatusDone}); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound saving an item, got %v", err)
+	}
+	if err := store.Finish(ctx, job.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound finishing, got %v", err)
+	}
+	for _, key := range []string{jobKey(job.ID), itemsKey(job.ID)} {
+		if s.Exists(key) {
+			t.Errorf("expected %s to stay expired", key)
+		}
+	}
+	if _, err := store.Get(ctx, job.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
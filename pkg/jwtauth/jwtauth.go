@@ -0,0 +1,207 @@
+package jwtauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leeway is the clock skew tolerated when checking the validity period of a token.
+const leeway = time.Minute
+
+var (
+	// ErrNoKey is returned by Verify when no key of the JWKS verifies the signature.
+	ErrNoKey = errors.New("no key verifies the token")
+	// ErrNoExpiry is returned by Verify for tokens without expiration.
+	ErrNoExpiry = errors.New("token does not expire")
+	// ErrNoName is returned by Verify for tokens without client_id, azp or sub claim,
+	// which would authenticate a client without a name.
+	ErrNoName = errors.New("token does not name the client")
+)
+
+// Identity is what a verified token says about the client.
+type Identity struct {
+	// Name is the client_id, azp or sub claim, the first one present.
+	Name   string
+	Scopes []string
+}
+
+// HasScope tells whether the token grants scope.
+func (i *Identity) HasScope(scope string) bool {
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifier verifies JWTs signed by one of the keys of a JWKS, read from a file or
+// downloaded from a URL, and issued by issuer for audience.
+type Verifier struct {
+	issuer   string
+	audience string
+	jwks     string
+	client   *http.Client
+	now      func() time.Time
+
+	mu   sync.RWMutex
+	keys *jose.JSONWebKeySet
+}
+
+// New returns a Verifier with the keys of jwks, a file path or an https URL.
+// The issuer and the audience are required, without them the tokens issued by the
+// same provider for any other application would be accepted.
+func New(issuer, audience, jwks string) (*Verifier, error) {
+	return newVerifier(issuer, audience, jwks, &http.Client{Timeout: 10 * time.Second})
+}
+
+func newVerifier(issuer, audience, jwks string, client *http.Client) (*Verifier, error) {
+	if issuer == "" || audience == "" {
+		return nil, errors.New("the issuer and the audience of the JWTs are required")
+	}
+	if strings.HasPrefix(jwks, "http://") {
+		return nil, fmt.Errorf("JWKS %s must be downloaded with https", jwks)
+	}
+	v := &Verifier{
+		issuer:   issuer,
+		audience: audience,
+		jwks:     jwks,
+		client:   client,
+		now:      time.Now,
+	}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// IsRemote tells whether the keys are downloaded, and so should be reloaded periodically.
+func (v *Verifier) IsRemote() bool {
+	return strings.HasPrefix(v.jwks, "https://")
+}
+
+// Reload reads the JWKS again. If it cannot be read the previous keys are kept.
+func (v *Verifier) Reload() error {
+	data, err := v.read()
+	if err != nil {
+		return err
+	}
+	keys := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(data, keys); err != nil {
+		return fmt.Errorf("invalid JWKS %s: %s", v.jwks, err)
+	}
+	if len(keys.Keys) == 0 {
+		return fmt.Errorf("no keys in JWKS %s", v.jwks)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	return nil
+}
+
+func (v *Verifier) read() ([]byte, error) {
+	if !v.IsRemote() {
+		return ioutil.ReadFile(v.jwks)
+	}
+	res, err := v.client.Get(v.jwks)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading JWKS %s: %s", v.jwks, res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// LooksLikeJWT tells whether token has the shape of a signed JWT, so it is not
+// confused with a static secret.
+func LooksLikeJWT(token string) bool {
+	_, err := jwt.ParseSigned(token)
+	return err == nil
+}
+
+// Verify checks the signature, the issuer, the audience and the validity period
+// of token and returns the identity of the client, which must have a name.
+func (v *Verifier) Verify(token string) (*Identity, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwt.Claims
+	var extra struct {
+		Scope    string      `json:"scope"`
+		Scp      interface{} `json:"scp"`
+		ClientID string      `json:"client_id"`
+		Azp      string      `json:"azp"`
+	}
+	if err := tok.Claims(v.key(tok), &claims, &extra); err != nil {
+		return nil, ErrNoKey
+	}
+
+	if claims.Expiry == nil {
+		return nil, ErrNoExpiry
+	}
+	expected := jwt.Expected{Issuer: v.issuer, Audience: jwt.Audience{v.audience}, Time: v.now()}
+	if err := claims.ValidateWithLeeway(expected, leeway); err != nil {
+		return nil, err
+	}
+
+	id := &Identity{Name: claims.Subject, Scopes: strings.Fields(extra.Scope)}
+	if extra.Azp != "" {
+		id.Name = extra.Azp
+	}
+	if extra.ClientID != "" {
+		id.Name = extra.ClientID
+	}
+	if id.Name == "" {
+		return nil, ErrNoName
+	}
+	// scp is a space separated string or an array depending on the provider
+	switch scp := extra.Scp.(type) {
+	case string:
+		id.Scopes = append(id.Scopes, strings.Fields(scp)...)
+	case []interface{}:
+		for _, s := range scp {
+			if s, ok := s.(string); ok {
+				id.Scopes = append(id.Scopes, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+// key returns the public key matching the kid of the token, or the only key of the
+// set if the token has no kid.
+func (v *Verifier) key(tok *jwt.JSONWebToken) interface{} {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var kid string
+	for _, h := range tok.Headers {
+		if h.KeyID != "" {
+			kid = h.KeyID
+			break
+		}
+	}
+	if kid != "" {
+		if keys := v.keys.Key(kid); len(keys) > 0 {
+			return keys[0].Public().Key
+		}
+		return nil
+	}
+	if len(v.keys.Keys) == 1 {
+		return v.keys.Keys[0].Public().Key
+	}
+	return nil
+}
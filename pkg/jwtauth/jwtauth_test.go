@@ -0,0 +1,225 @@
+package jwtauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newKey(t *testing.T, kid string) jose.JSONWebKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"}
+}
+
+func writeJWKS(t *testing.T, dir string, keys ...jose.JSONWebKey) string {
+	set := jose.JSONWebKeySet{}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.Public())
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sign(t *testing.T, key jose.JSONWebKey, claims ...interface{}) string {
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if key.KeyID != "" {
+		opts = opts.WithHeader("kid", key.KeyID)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key.Key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := jwt.Signed(signer)
+	for _, c := range claims {
+		builder = builder.Claims(c)
+	}
+	token, err := builder.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, other := newKey(t, "k1"), newKey(t, "k2")
+	v, err := New("https://issuer", "cboxgroupd", writeJWKS(t, dir, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	valid := jwt.Claims{
+		Issuer:   "https://issuer",
+		Audience: jwt.Audience{"cboxgroupd"},
+		Subject:  "svc",
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		err    bool
+		id     string
+		scopes []string
+	}{
+		{"valid", sign(t, key, valid, map[string]interface{}{"scope": "groups:read groups:update"}), false, "svc", []string{"groups:read", "groups:update"}},
+		{"scp array", sign(t, key, valid, map[string]interface{}{"scp": []string{"groups:read"}, "client_id": "web"}), false, "web", []string{"groups:read"}},
+		{"azp", sign(t, key, valid, map[string]interface{}{"azp": "cli"}), false, "cli", nil},
+		{"expired", sign(t, key, jwt.Claims{Issuer: valid.Issuer, Audience: valid.Audience, Expiry: jwt.NewNumericDate(now.Add(-2 * time.Minute))}), true, "", nil},
+		{"within leeway", sign(t, key, jwt.Claims{Issuer: valid.Issuer, Audience: valid.Audience, Subject: "svc", Expiry: jwt.NewNumericDate(now.Add(-30 * time.Second))}), false, "svc", nil},
+		{"no expiry", sign(t, key, jwt.Claims{Issuer: valid.Issuer, Audience: valid.Audience}), true, "", nil},
+		{"wrong issuer", sign(t, key, jwt.Claims{Issuer: "https://other", Audience: valid.Audience, Expiry: valid.Expiry}), true, "", nil},
+		{"wrong audience", sign(t, key, jwt.Claims{Issuer: valid.Issuer, Audience: jwt.Audience{"other"}, Expiry: valid.Expiry}), true, "", nil},
+		{"unknown key", sign(t, other, valid), true, "", nil},
+		{"wrong key with known kid", sign(t, jose.JSONWebKey{Key: other.Key, KeyID: "k1"}, valid), true, "", nil},
+		{"no kid", sign(t, jose.JSONWebKey{Key: key.Key}, valid), false, "svc", nil},
+		{"not a jwt", "s3cret", true, "", nil},
+	}
+	for _, test := range tests {
+		id, err := v.Verify(test.token)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if id.Name != test.id || (len(id.Scopes) > 0 || len(test.scopes) > 0) && !reflect.DeepEqual(id.Scopes, test.scopes) {
+			t.Errorf("%s: unexpected identity %+v", test.name, id)
+		}
+	}
+}
+
+func TestVerifyRequiresName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := newKey(t, "k1")
+	v, err := New("https://issuer", "cboxgroupd", writeJWKS(t, dir, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.Claims{Issuer: "https://issuer", Audience: jwt.Audience{"cboxgroupd"}, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	for _, extra := range []map[string]interface{}{
+		{"scope": "groups:admin"},
+		{"scope": "groups:admin", "sub": "", "azp": "", "client_id": ""},
+	} {
+		if id, err := v.Verify(sign(t, key, claims, extra)); err != ErrNoName {
+			t.Errorf("expected ErrNoName for %v, got %+v and %v", extra, id, err)
+		}
+	}
+}
+
+func TestReloadRemote(t *testing.T) {
+	key, rotated := newKey(t, "k1"), newKey(t, "k2")
+	current := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(current)
+	}))
+	defer srv.Close()
+
+	v, err := newVerifier("https://issuer", "cboxgroupd", srv.URL, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.IsRemote() {
+		t.Fatal("expected a remote JWKS")
+	}
+	claims := jwt.Claims{Issuer: "https://issuer", Audience: jwt.Audience{"cboxgroupd"}, Subject: "svc", Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	if _, err := v.Verify(sign(t, rotated, claims)); err != ErrNoKey {
+		t.Fatalf("expected ErrNoKey before the rotation, got %v", err)
+	}
+
+	current = jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public(), rotated.Public()}}
+	if err := v.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(sign(t, rotated, claims)); err != nil {
+		t.Fatalf("expected the rotated key to be accepted, got %v", err)
+	}
+}
+
+func TestLooksLikeJWT(t *testing.T) {
+	if LooksLikeJWT("change_me!!!") || LooksLikeJWT("a.b.c") {
+		t.Error("secret taken for a JWT")
+	}
+	if !LooksLikeJWT(sign(t, newKey(t, ""), jwt.Claims{Subject: "svc"})) {
+		t.Error("JWT not recognized")
+	}
+}
+
+func TestNewRequiresIssuerAndAudience(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jwks := writeJWKS(t, dir, newKey(t, "k1"))
+
+	for _, test := range []struct{ issuer, audience, jwks string }{
+		{"", "cboxgroupd", jwks},
+		{"https://issuer", "", jwks},
+		{"https://issuer", "cboxgroupd", "http://issuer/jwks.json"},
+	} {
+		if _, err := New(test.issuer, test.audience, test.jwks); err == nil {
+			t.Errorf("expected error for issuer %q, audience %q and JWKS %q", test.issuer, test.audience, test.jwks)
+		}
+	}
+}
+
+func TestVerifyRejectsOtherApplications(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the same provider signs the tokens of every application
+	key := newKey(t, "k1")
+	v, err := New("https://issuer", "cboxgroupd", writeJWKS(t, dir, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := jwt.NewNumericDate(time.Now().Add(time.Hour))
+	for _, claims := range []jwt.Claims{
+		{Issuer: "https://issuer", Audience: jwt.Audience{"other-app"}, Subject: "svc", Expiry: expiry},
+		{Issuer: "https://issuer", Subject: "svc", Expiry: expiry},
+		{Issuer: "https://other-issuer", Audience: jwt.Audience{"cboxgroupd"}, Subject: "svc", Expiry: expiry},
+		{Audience: jwt.Audience{"cboxgroupd"}, Subject: "svc", Expiry: expiry},
+	} {
+		if _, err := v.Verify(sign(t, key, claims)); err == nil {
+			t.Errorf("token for issuer %q and audience %v accepted", claims.Issuer, claims.Audience)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package ldapgrouplooker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"gopkg.in/ldap.v2"
+	"net"
+)
+
+// mapError turns the errors of the LDAP client into GroupLookerErrors wrapping them.
+// Errors without an equivalent code are returned as they are.
+func mapError(err error) error {
+	var gle pkg.GroupLookerError
+	if err == nil || errors.As(err, &gle) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return lookerError(pkg.GroupLookerErrorTimeout, "LDAP lookup timed out", err)
+	}
+
+	var le *ldap.Error
+	if !errors.As(err, &le) {
+		return err
+	}
+	switch le.ResultCode {
+	case ldap.ErrorNetwork:
+		if ne, ok := le.Err.(net.Error); ok && ne.Timeout() {
+			return lookerError(pkg.GroupLookerErrorTimeout, "LDAP server did not answer in time", err)
+		}
+		return lookerError(pkg.GroupLookerErrorUnavailable, "LDAP server unavailable", err)
+	case ldap.LDAPResultBusy, ldap.LDAPResultUnavailable, ldap.LDAPResultUnwillingToPerform:
+		return lookerError(pkg.GroupLookerErrorUnavailable, "LDAP server unavailable", err)
+	case ldap.LDAPResultTimeLimitExceeded:
+		return lookerError(pkg.GroupLookerErrorTimeout, "LDAP lookup timed out", err)
+	case ldap.LDAPResultSizeLimitExceeded, ldap.LDAPResultAdminLimitExceeded:
+		return lookerError(pkg.GroupLookerErrorTooLarge, "too many LDAP entries", err)
+	case ldap.LDAPResultInsufficientAccessRights, ldap.LDAPResultInvalidCredentials,
+		ldap.LDAPResultInappropriateAuthentication, ldap.LDAPResultStrongAuthRequired, ldap.LDAPResultConfidentialityRequired:
+		return lookerError(pkg.GroupLookerErrorPermissionDenied, "LDAP lookup not allowed", err)
+	case ldap.LDAPResultNoSuchObject:
+		return lookerError(pkg.GroupLookerErrorNotFound, "no such LDAP entry", err)
+	case ldap.LDAPResultInvalidDNSyntax, ldap.ErrorFilterCompile:
+		return lookerError(pkg.GroupLookerErrorInvalidArgument, "invalid LDAP query", err)
+	}
+	return err
+}
+
+// userNotFound is the error for a user without an LDAP entry, cause is the error of
+// the search if it failed.
+func userNotFound(uid string, cause error) error {
+	return lookerError(pkg.GroupLookerErrorNotFound, fmt.Sprintf("user %s not found", uid), cause)
+}
+
+func lookerError(code pkg.GroupLookerErrorCode, message string, cause error) error {
+	return pkg.NewGroupLookerError(code).WithMessage(message).WithCause(cause)
+}
@@ -0,0 +1,57 @@
+package ldapgrouplooker
+
+import (
+	"context"
+	"errors"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"gopkg.in/ldap.v2"
+	"testing"
+)
+
+func TestMapError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code pkg.GroupLookerErrorCode
+	}{
+		{ldap.NewError(ldap.ErrorNetwork, errors.New("dial tcp: connection refused")), pkg.GroupLookerErrorUnavailable},
+		{ldap.NewError(ldap.LDAPResultBusy, errors.New("busy")), pkg.GroupLookerErrorUnavailable},
+		{ldap.NewError(ldap.LDAPResultTimeLimitExceeded, errors.New("time limit")), pkg.GroupLookerErrorTimeout},
+		{ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit")), pkg.GroupLookerErrorTooLarge},
+		{ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("access")), pkg.GroupLookerErrorPermissionDenied},
+		{ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object")), pkg.GroupLookerErrorNotFound},
+		{ldap.NewError(ldap.ErrorFilterCompile, errors.New("bad filter")), pkg.GroupLookerErrorInvalidArgument},
+		{context.DeadlineExceeded, pkg.GroupLookerErrorTimeout},
+	}
+	for _, test := range tests {
+		err := mapError(test.err)
+		if !errors.Is(err, pkg.NewGroupLookerError(test.code)) {
+			t.Errorf("%v: expected %s, got %v", test.err, test.code, err)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%v: cause not wrapped", test.err)
+		}
+		if again := mapError(err); again.Error() != err.Error() {
+			t.Errorf("%v: mapped twice: %v", test.err, again)
+		}
+	}
+
+	other := ldap.NewError(ldap.LDAPResultOther, errors.New("other"))
+	if err := mapError(other); err != other {
+		t.Errorf("unexpected mapping of %v: %v", other, err)
+	}
+	if mapError(nil) != nil {
+		t.Error("nil mapped to an error")
+	}
+}
+
+func TestUserNotFound(t *testing.T) {
+	cause := mapError(ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object")))
+	err := userNotFound("nobody", cause)
+	if !errors.Is(err, pkg.ErrNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	var gle pkg.GroupLookerError
+	if !errors.As(err, &gle) || gle.Message != "user nobody not found" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
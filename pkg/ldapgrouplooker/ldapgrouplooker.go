@@ -3,14 +3,21 @@ package ldapgrouplooker
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/cernbox/cboxgroupd/pkg"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/ldap.v2"
 	"strconv"
 	"strings"
 	"time"
 )
 
+var tracer = otel.Tracer("github.com/cernbox/cboxgroupd/pkg/ldapgrouplooker")
+
 func New(hostname string, port int, pageLimit uint32) pkg.GroupLooker {
 	return &groupLooker{
 		hostname:  hostname,
@@ -28,7 +35,10 @@ type groupLooker struct {
 // GetUsersInGroup is an expensive query that can put the cluster down if there are a lot of concurrent connections.
 // Try to minimize its usage.
 func (gl *groupLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
-	l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", gl.hostname, gl.port))
+	ctx, span := tracer.Start(ctx, "ldapgrouplooker.GetUsersInGroup", trace.WithAttributes(attribute.String("gid", gid)))
+	defer span.End()
+
+	l, err := gl.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -37,12 +47,12 @@ func (gl *groupLooker) GetUsersInGroup(ctx context.Context, gid string, cached b
 	searchRequest := ldap.NewSearchRequest(
 		"OU=Users,OU=Organic Units,DC=cern,DC=ch",
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(memberOf:1.2.840.113556.1.4.1941:=CN=%s,OU=e-groups,OU=Workgroups,DC=cern,DC=ch)", gid),
+		fmt.Sprintf("(memberOf:1.2.840.113556.1.4.1941:=CN=%s,OU=e-groups,OU=Workgroups,DC=cern,DC=ch)", ldap.EscapeFilter(escapeDN(gid))),
 		[]string{"dn", "sAMAccountName", "memberOf"},
 		nil,
 	)
 
-	sr, err := l.SearchWithPaging(searchRequest, gl.pageLimit)
+	sr, err := gl.search(ctx, l, searchRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +70,11 @@ func (gl *groupLooker) GetUsersInGroup(ctx context.Context, gid string, cached b
 		}
 	}
 
+	if len(uids) == 0 {
+		if err := gl.groupExists(ctx, l, "OU=e-groups,OU=Workgroups,DC=cern,DC=ch", gid); err != nil {
+			return nil, err
+		}
+	}
 	return uids, nil
 }
 
@@ -73,25 +88,32 @@ func (gl *groupLooker) GetUsersInGroup(ctx context.Context, gid string, cached b
 // The filter can be huge and hit the maximum allowed size imposed by AD, so in case we see failures we need to run it in chunks.
 // The decoding is based on little endian, in something does not seem to work, probably is because of the architecture. Be aware.
 func (gl *groupLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
-	l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", gl.hostname, gl.port))
+	ctx, span := tracer.Start(ctx, "ldapgrouplooker.GetUserGroups", trace.WithAttributes(attribute.String("uid", uid)))
+	defer span.End()
+
+	l, err := gl.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer l.Close()
 
 	searchRequest := ldap.NewSearchRequest(
-		fmt.Sprintf("CN=%s,OU=Users,OU=Organic Units,DC=cern,DC=ch", uid),
+		fmt.Sprintf("CN=%s,OU=Users,OU=Organic Units,DC=cern,DC=ch", escapeDN(uid)),
 		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
 		"(objectClass=User)",
 		[]string{"tokenGroups"},
 		nil,
 	)
 
-	sr, err := l.SearchWithPaging(searchRequest, gl.pageLimit)
+	sr, err := gl.search(ctx, l, searchRequest)
+	if errors.Is(err, pkg.ErrNotFound) || (err == nil && len(sr.Entries) == 0) {
+		return nil, userNotFound(uid, err)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	_, decodeSpan := tracer.Start(ctx, "decodeSIDs")
 	var sids []string
 	for _, entry := range sr.Entries {
 		for _, attr := range entry.Attributes {
@@ -116,6 +138,9 @@ func (gl *groupLooker) GetUserGroups(ctx context.Context, uid string, cached boo
 		}
 	}
 
+	decodeSpan.SetAttributes(attribute.Int("sids", len(sids)))
+	decodeSpan.End()
+
 	groupsFilter := "(&(objectClass=Group)(|%s))"
 	var query string
 	for _, sid := range sids {
@@ -131,7 +156,7 @@ func (gl *groupLooker) GetUserGroups(ctx context.Context, uid string, cached boo
 		nil,
 	)
 
-	sr, err = l.SearchWithPaging(searchRequest, gl.pageLimit)
+	sr, err = gl.search(ctx, l, searchRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -150,7 +175,10 @@ func (gl *groupLooker) GetUserGroups(ctx context.Context, uid string, cached boo
 }
 
 func (gl *groupLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
-	l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", gl.hostname, gl.port))
+	ctx, span := tracer.Start(ctx, "ldapgrouplooker.GetUsersInComputingGroup", trace.WithAttributes(attribute.String("gid", gid)))
+	defer span.End()
+
+	l, err := gl.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -159,12 +187,12 @@ func (gl *groupLooker) GetUsersInComputingGroup(ctx context.Context, gid string,
 	searchRequest := ldap.NewSearchRequest(
 		"OU=Users,OU=Organic Units,DC=cern,DC=ch",
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(memberOf:1.2.840.113556.1.4.1941:=CN=%s,OU=unix,OU=Workgroups,DC=cern,DC=ch)", gid),
+		fmt.Sprintf("(memberOf:1.2.840.113556.1.4.1941:=CN=%s,OU=unix,OU=Workgroups,DC=cern,DC=ch)", ldap.EscapeFilter(escapeDN(gid))),
 		[]string{"dn", "sAMAccountName", "memberOf"},
 		nil,
 	)
 
-	sr, err := l.SearchWithPaging(searchRequest, gl.pageLimit)
+	sr, err := gl.search(ctx, l, searchRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -182,11 +210,19 @@ func (gl *groupLooker) GetUsersInComputingGroup(ctx context.Context, gid string,
 		}
 	}
 
+	if len(uids) == 0 {
+		if err := gl.groupExists(ctx, l, "OU=unix,OU=Workgroups,DC=cern,DC=ch", gid); err != nil {
+			return nil, err
+		}
+	}
 	return uids, nil
 }
 
 func (gl *groupLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
-	l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", gl.hostname, gl.port))
+	ctx, span := tracer.Start(ctx, "ldapgrouplooker.GetUserComputingGroups", trace.WithAttributes(attribute.String("uid", uid)))
+	defer span.End()
+
+	l, err := gl.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -195,15 +231,18 @@ func (gl *groupLooker) GetUserComputingGroups(ctx context.Context, uid string, c
 	searchRequest := ldap.NewSearchRequest(
 		"OU=Users,OU=Organic Units,DC=cern,DC=ch",
 		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(cn=%s)", uid),
+		fmt.Sprintf("(cn=%s)", ldap.EscapeFilter(uid)),
 		[]string{"dn", "memberOf"},
 		nil,
 	)
 
-	sr, err := l.SearchWithPaging(searchRequest, gl.pageLimit)
+	sr, err := gl.search(ctx, l, searchRequest)
 	if err != nil {
 		return nil, err
 	}
+	if len(sr.Entries) == 0 {
+		return nil, userNotFound(uid, nil)
+	}
 
 	var gids []string
 	for _, entry := range sr.Entries {
@@ -229,8 +268,56 @@ func (gl *groupLooker) GetUserComputingGroups(ctx context.Context, uid string, c
 	return gids, nil
 }
 
+// IsUserInGroup reads only the entry of the user, with the members of the e-group and
+// of its nested groups matched by the server, instead of listing the whole group.
+func (gl *groupLooker) IsUserInGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	ctx, span := tracer.Start(ctx, "ldapgrouplooker.IsUserInGroup", trace.WithAttributes(attribute.String("uid", uid), attribute.String("gid", gid)))
+	defer span.End()
+	return gl.isMember(ctx, uid, gid, "OU=e-groups,OU=Workgroups,DC=cern,DC=ch")
+}
+
+func (gl *groupLooker) IsUserInComputingGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	ctx, span := tracer.Start(ctx, "ldapgrouplooker.IsUserInComputingGroup", trace.WithAttributes(attribute.String("uid", uid), attribute.String("gid", gid)))
+	defer span.End()
+	return gl.isMember(ctx, uid, gid, "OU=unix,OU=Workgroups,DC=cern,DC=ch")
+}
+
+func (gl *groupLooker) isMember(ctx context.Context, uid, gid, groupsDN string) (bool, error) {
+	l, err := gl.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer l.Close()
+
+	searchRequest := ldap.NewSearchRequest(
+		fmt.Sprintf("CN=%s,OU=Users,OU=Organic Units,DC=cern,DC=ch", escapeDN(uid)),
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(memberOf:1.2.840.113556.1.4.1941:=CN=%s,%s)", ldap.EscapeFilter(escapeDN(gid)), groupsDN),
+		[]string{"dn"},
+		nil,
+	)
+
+	sr, err := gl.search(ctx, l, searchRequest)
+	if errors.Is(err, pkg.ErrNotFound) {
+		return false, userNotFound(uid, err)
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(sr.Entries) > 0 {
+		return true, nil
+	}
+	if err := gl.groupExists(ctx, l, groupsDN, gid); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
 func (gl *groupLooker) Search(ctx context.Context, filter string, cached bool) ([]*pkg.SearchEntry, error) {
-	l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", gl.hostname, gl.port))
+	ctx, span := tracer.Start(ctx, "ldapgrouplooker.Search", trace.WithAttributes(attribute.String("filter", filter)))
+	defer span.End()
+
+	l, err := gl.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -262,7 +349,7 @@ func (gl *groupLooker) Search(ctx context.Context, filter string, cached bool) (
 			nil,
 		)
 
-		sr, err := l.SearchWithPaging(searchRequest, gl.pageLimit)
+		sr, err := gl.search(ctx, l, searchRequest)
 		if err != nil {
 			return nil, err
 		}
@@ -297,7 +384,7 @@ func (gl *groupLooker) Search(ctx context.Context, filter string, cached bool) (
 			nil,
 		)
 
-		sr, err := l.SearchWithPaging(searchRequest, gl.pageLimit)
+		sr, err := gl.search(ctx, l, searchRequest)
 		if err != nil {
 			return nil, err
 		}
@@ -329,7 +416,7 @@ func (gl *groupLooker) Search(ctx context.Context, filter string, cached bool) (
 			nil,
 		)
 
-		sr, err := l.SearchWithPaging(searchRequest, gl.pageLimit)
+		sr, err := gl.search(ctx, l, searchRequest)
 		if err != nil {
 			return nil, err
 		}
@@ -369,6 +456,127 @@ func (gl *groupLooker) GetTTLForComputingGroup(ctx context.Context, gid string)
 	return time.Duration(-1), nil
 }
 
+// Ping checks that the LDAP server answers by reading its root DSE anonymously.
+func (gl *groupLooker) Ping(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "ldapgrouplooker.Ping")
+	defer span.End()
+
+	// the LDAP client does not use contexts, stop waiting for it when ctx is done
+	errc := make(chan error, 1)
+	go func() {
+		l, err := gl.dial(ctx)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer l.Close()
+
+		searchRequest := ldap.NewSearchRequest(
+			"",
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			[]string{"namingContexts"},
+			nil,
+		)
+		_, err = l.Search(searchRequest)
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return mapError(err)
+	case <-ctx.Done():
+		span.SetStatus(codes.Error, ctx.Err().Error())
+		return mapError(ctx.Err())
+	}
+}
+
+func (gl *groupLooker) dial(ctx context.Context) (*ldap.Conn, error) {
+	_, span := tracer.Start(ctx, "ldap.Dial", trace.WithAttributes(attribute.String("ldap.hostname", gl.hostname)))
+	defer span.End()
+
+	l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", gl.hostname, gl.port))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, mapError(err)
+	}
+	return l, nil
+}
+
+// searcher is the part of *ldap.Conn used by search.
+type searcher interface {
+	SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error)
+}
+
+func (gl *groupLooker) search(ctx context.Context, l searcher, searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	_, span := tracer.Start(ctx, "ldap.SearchWithPaging", trace.WithAttributes(attribute.String("ldap.basedn", searchRequest.BaseDN)))
+	defer span.End()
+
+	// the filter of GetUserGroups contains all the SIDs of the user, do not record it whole
+	if len(searchRequest.Filter) <= 512 {
+		span.SetAttributes(attribute.String("ldap.filter", searchRequest.Filter))
+	} else {
+		span.SetAttributes(attribute.Int("ldap.filterlength", len(searchRequest.Filter)))
+	}
+
+	sr, err := l.SearchWithPaging(searchRequest, gl.pageLimit)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, mapError(err)
+	}
+	span.SetAttributes(attribute.Int("ldap.entries", len(sr.Entries)))
+	return sr, nil
+}
+
+// groupExists returns a NotFound error if there is no group gid under baseDN.
+// Searches for the members of a group that does not exist succeed without entries,
+// this tells them apart from empty groups.
+func (gl *groupLooker) groupExists(ctx context.Context, l searcher, baseDN, gid string) error {
+	searchRequest := ldap.NewSearchRequest(
+		baseDN,
+		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(&(objectClass=group)(cn=%s))", ldap.EscapeFilter(gid)),
+		[]string{"dn"},
+		nil,
+	)
+
+	sr, err := gl.search(ctx, l, searchRequest)
+	if err != nil {
+		return err
+	}
+	if len(sr.Entries) == 0 {
+		return pkg.ErrNotFound.WithMessage(fmt.Sprintf("group %s not found", gid))
+	}
+	return nil
+}
+
+// escapeDN escapes value for an attribute value of a DN, as described by RFC 4514,
+// so that a name cannot change the base of a search. A DN inside a filter must be
+// escaped for the filter as well.
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 0:
+			b.WriteString(`\00`)
+			continue
+		case strings.IndexByte(`"+,;<>\\`, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
 func getLDAPAccountTypeForUser(t string) pkg.LDAPAccountType {
 	switch t {
 	case "Primary":
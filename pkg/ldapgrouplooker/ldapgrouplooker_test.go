@@ -2,7 +2,11 @@ package ldapgrouplooker
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"gopkg.in/ldap.v2"
+	"os"
 	"testing"
 )
 
@@ -29,3 +33,85 @@ func TestComputingGroups(t *testing.T) {
 		fmt.Println(g)
 	}
 }
+
+// TestMembership checks the membership answers of a live LDAP server. It only runs with
+// CBOXGROUPD_TEST_LDAP set to the host and CBOXGROUPD_TEST_UID, CBOXGROUPD_TEST_GROUP and
+// CBOXGROUPD_TEST_COMPUTINGGROUP set to a user and an e-group and a computing group it is in.
+func TestMembership(t *testing.T) {
+	host := os.Getenv("CBOXGROUPD_TEST_LDAP")
+	uid, gid, computingGid := os.Getenv("CBOXGROUPD_TEST_UID"), os.Getenv("CBOXGROUPD_TEST_GROUP"), os.Getenv("CBOXGROUPD_TEST_COMPUTINGGROUP")
+	if host == "" || uid == "" || gid == "" || computingGid == "" {
+		t.Skip("CBOXGROUPD_TEST_LDAP, CBOXGROUPD_TEST_UID, CBOXGROUPD_TEST_GROUP or CBOXGROUPD_TEST_COMPUTINGGROUP not set")
+	}
+	ctx := context.Background()
+	gl := New(host, 389, 1000)
+
+	if ok, err := gl.IsUserInGroup(ctx, uid, gid, false); err != nil || !ok {
+		t.Errorf("expected %s to be in %s, got %t %v", uid, gid, ok, err)
+	}
+	if ok, err := gl.IsUserInComputingGroup(ctx, uid, computingGid, false); err != nil || !ok {
+		t.Errorf("expected %s to be in the computing group %s, got %t %v", uid, computingGid, ok, err)
+	}
+	if _, err := gl.IsUserInGroup(ctx, uid, "no-such-egroup-cboxgroupd", false); !errors.Is(err, pkg.ErrNotFound) {
+		t.Errorf("expected not found for an unknown group, got %v", err)
+	}
+}
+
+// groupSearcher answers the searches for the groups it has.
+type groupSearcher struct {
+	groups  map[string]bool
+	filters []string
+}
+
+func (s *groupSearcher) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	s.filters = append(s.filters, searchRequest.Filter)
+	sr := &ldap.SearchResult{}
+	for gid := range s.groups {
+		if searchRequest.Filter == fmt.Sprintf("(&(objectClass=group)(cn=%s))", gid) {
+			sr.Entries = append(sr.Entries, &ldap.Entry{DN: "CN=" + gid + ",OU=e-groups,OU=Workgroups,DC=cern,DC=ch"})
+		}
+	}
+	return sr, nil
+}
+
+// TestGroupExists checks how a search for members without entries is told apart:
+// an empty group exists, an unknown one is not found.
+func TestGroupExists(t *testing.T) {
+	ctx := context.Background()
+	gl := &groupLooker{pageLimit: 1000}
+	s := &groupSearcher{groups: map[string]bool{"empty-group": true}}
+
+	if err := gl.groupExists(ctx, s, "OU=e-groups,OU=Workgroups,DC=cern,DC=ch", "empty-group"); err != nil {
+		t.Errorf("expected an empty group to exist, got %v", err)
+	}
+	err := gl.groupExists(ctx, s, "OU=e-groups,OU=Workgroups,DC=cern,DC=ch", "no-such-group")
+	if !errors.Is(err, pkg.ErrNotFound) || err.Error() != "GROUPLOOKER_ERROR_NOT_FOUND: group no-such-group not found" {
+		t.Errorf("expected not found for an unknown group, got %v", err)
+	}
+
+	// the gid is escaped, it cannot match other groups
+	if err := gl.groupExists(ctx, s, "OU=e-groups,OU=Workgroups,DC=cern,DC=ch", "*"); !errors.Is(err, pkg.ErrNotFound) {
+		t.Errorf("expected not found for *, got %v", err)
+	}
+	if f := s.filters[len(s.filters)-1]; f != `(&(objectClass=group)(cn=\2a))` {
+		t.Errorf("unexpected filter %s", f)
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	tests := map[string]string{
+		"gonzalhu":           "gonzalhu",
+		"a,OU=Other,DC=evil": `a\,OU=Other\,DC=evil`,
+		`quote"plus+semi;`:   `quote\"plus\+semi\;`,
+		`<back\slash>`:       `\<back\\slash\>`,
+		"#hash":              `\#hash`,
+		" spaces ":           `\ spaces\ `,
+		"in # the middle":    "in # the middle",
+		"nul\x00":            `nul\00`,
+	}
+	for value, expected := range tests {
+		if got := escapeDN(value); got != expected {
+			t.Errorf("escapeDN(%q) = %q, expected %q", value, got, expected)
+		}
+	}
+}
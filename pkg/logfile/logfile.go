@@ -0,0 +1,71 @@
+package logfile
+
+import (
+	"os"
+	"sync"
+)
+
+// File is a log file that can be reopened, so that logrotate can move it away and
+// signal the daemon instead of truncating it.
+// The special names stderr and stdout are never reopened.
+type File struct {
+	path string
+	perm os.FileMode
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Open opens path for appending, creating it readable by everyone if needed.
+func Open(path string) (*File, error) {
+	return OpenMode(path, 0644)
+}
+
+// OpenMode opens path for appending, creating it with perm if needed.
+func OpenMode(path string, perm os.FileMode) (*File, error) {
+	switch path {
+	case "stderr":
+		return &File{path: path, f: os.Stderr}, nil
+	case "stdout":
+		return &File{path: path, f: os.Stdout}, nil
+	}
+	f, err := open(path, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: path, perm: perm, f: f}, nil
+}
+
+func open(path string, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, perm)
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f.Write(p)
+}
+
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f.Sync()
+}
+
+// Reopen closes the file and opens path again.
+// If path cannot be opened the old file is kept.
+func (f *File) Reopen() error {
+	if f.path == "stderr" || f.path == "stdout" {
+		return nil
+	}
+	nf, err := open(f.path, f.perm)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	old := f.f
+	f.f = nf
+	f.mu.Unlock()
+	return old.Close()
+}
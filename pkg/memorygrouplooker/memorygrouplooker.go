@@ -0,0 +1,373 @@
+package memorygrouplooker
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/cachestats"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memorygrouplooker is a wrapper around any GroupLooker that will cache
+// results in memory for a given TTL.
+// The cache holds at most maxEntries keys, when it is full the oldest entry is evicted.
+// A janitor goroutine removes the expired entries every cleanupInterval.
+// It is meant for single node deployments and tests, as the cache is not shared between
+// instances and it is lost on restart.
+func New(ttl, maxEntries int, cleanupInterval time.Duration, wrapped pkg.GroupLooker) pkg.GroupLooker {
+	gl := &groupLooker{
+		ttl:        int64(ttl),
+		maxEntries: maxEntries,
+		wrapped:    wrapped,
+		stats:      cachestats.New(),
+		items:      map[string]*list.Element{},
+		order:      list.New(),
+		now:        time.Now,
+		done:       make(chan struct{}),
+	}
+	go gl.janitor(cleanupInterval)
+	return gl
+}
+
+type item struct {
+	key     string
+	expires time.Time
+	value   interface{}
+}
+
+type groupLooker struct {
+	ttl        int64
+	maxEntries int
+	wrapped    pkg.GroupLooker
+	stats      *cachestats.Stats
+
+	// all entries have the same TTL, so the insertion order kept in order
+	// is also the expiration order: the front element is the first to expire.
+	// After SetTTL lowers the TTL this is briefly not true and the janitor removes
+	// the newer entries a bit late, get checks the expiration anyway.
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+	now   func() time.Time
+	done  chan struct{}
+}
+
+// Stats returns the hit/miss counters of the cache.
+func (gl *groupLooker) Stats() *cachestats.Stats {
+	return gl.stats
+}
+
+// SetTTL changes the TTL of the entries cached from now on, the existing ones keep theirs.
+func (gl *groupLooker) SetTTL(ttl int) {
+	atomic.StoreInt64(&gl.ttl, int64(ttl))
+}
+
+func (gl *groupLooker) expiration() time.Duration {
+	return time.Second * time.Duration(atomic.LoadInt64(&gl.ttl))
+}
+
+// Close stops the janitor.
+func (gl *groupLooker) Close() error {
+	close(gl.done)
+	return nil
+}
+
+func (gl *groupLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	key := fmt.Sprintf("egroup:%s", gid)
+
+	if cached {
+		if uids, ok := gl.get(cachestats.KindGroup, key); ok {
+			return copyStrings(uids.([]string)), nil
+		}
+	} else {
+		gl.stats.Refresh(cachestats.KindGroup)
+	}
+
+	start := time.Now()
+	uids, err := gl.wrapped.GetUsersInGroup(ctx, gid, false)
+	gl.stats.ObserveLDAP(cachestats.KindGroup, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	gl.set(key, copyStrings(uids))
+	return uids, nil
+}
+
+func (gl *groupLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	key := fmt.Sprintf("unixgroup:%s", gid)
+
+	if cached {
+		if uids, ok := gl.get(cachestats.KindComputingGroup, key); ok {
+			return copyStrings(uids.([]string)), nil
+		}
+	} else {
+		gl.stats.Refresh(cachestats.KindComputingGroup)
+	}
+
+	start := time.Now()
+	uids, err := gl.wrapped.GetUsersInComputingGroup(ctx, gid, false)
+	gl.stats.ObserveLDAP(cachestats.KindComputingGroup, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	gl.set(key, copyStrings(uids))
+	return uids, nil
+}
+
+func (gl *groupLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	key := fmt.Sprintf("u:%s", uid)
+
+	if cached {
+		if gids, ok := gl.get(cachestats.KindUser, key); ok {
+			return copyStrings(gids.([]string)), nil
+		}
+	} else {
+		gl.stats.Refresh(cachestats.KindUser)
+	}
+
+	start := time.Now()
+	gids, err := gl.wrapped.GetUserGroups(ctx, uid, false)
+	gl.stats.ObserveLDAP(cachestats.KindUser, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	gl.set(key, copyStrings(gids))
+	return gids, nil
+}
+
+func (gl *groupLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	key := fmt.Sprintf("unixuser:%s", uid)
+
+	if cached {
+		if gids, ok := gl.get(cachestats.KindComputingUser, key); ok {
+			return copyStrings(gids.([]string)), nil
+		}
+	} else {
+		gl.stats.Refresh(cachestats.KindComputingUser)
+	}
+
+	start := time.Now()
+	gids, err := gl.wrapped.GetUserComputingGroups(ctx, uid, false)
+	gl.stats.ObserveLDAP(cachestats.KindComputingUser, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	gl.set(key, copyStrings(gids))
+	return gids, nil
+}
+
+func (gl *groupLooker) Search(ctx context.Context, filter string, cached bool) ([]*pkg.SearchEntry, error) {
+	key := fmt.Sprintf("filter:%s", filter)
+
+	if cached {
+		if entries, ok := gl.get(cachestats.KindSearch, key); ok {
+			return copyEntries(entries.([]*pkg.SearchEntry)), nil
+		}
+	} else {
+		gl.stats.Refresh(cachestats.KindSearch)
+	}
+
+	start := time.Now()
+	entries, err := gl.wrapped.Search(ctx, filter, false)
+	gl.stats.ObserveLDAP(cachestats.KindSearch, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	gl.set(key, copyEntries(entries))
+	return entries, nil
+}
+
+func (gl *groupLooker) GetTTLForUser(ctx context.Context, uid string) (time.Duration, error) {
+	key := fmt.Sprintf("u:%s", uid)
+	return gl.getTTL(key), nil
+}
+
+func (gl *groupLooker) GetTTLForGroup(ctx context.Context, gid string) (time.Duration, error) {
+	key := fmt.Sprintf("egroup:%s", gid)
+	return gl.getTTL(key), nil
+}
+
+func (gl *groupLooker) GetTTLForComputingGroup(ctx context.Context, gid string) (time.Duration, error) {
+	key := fmt.Sprintf("unixgroup:%s", gid)
+	return gl.getTTL(key), nil
+}
+
+func (gl *groupLooker) GetTTLForComputingUser(ctx context.Context, uid string) (time.Duration, error) {
+	key := fmt.Sprintf("unixuser:%s", uid)
+	return gl.getTTL(key), nil
+}
+
+// IsUserInGroup answers from the cached members of gid or, else, the cached groups of uid,
+// both include the nested groups. If neither is cached it asks the wrapped GroupLooker and
+// does not cache the answer.
+func (gl *groupLooker) IsUserInGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	return gl.isMember(ctx, fmt.Sprintf("egroup:%s", gid), uid, fmt.Sprintf("u:%s", uid), gid, cached, gl.wrapped.IsUserInGroup)
+}
+
+// IsUserInComputingGroup answers only from the cached members of gid: the cached computing
+// groups of uid are the direct ones, a member through a nested group is not in them.
+func (gl *groupLooker) IsUserInComputingGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	return gl.isMember(ctx, fmt.Sprintf("unixgroup:%s", gid), uid, "", gid, cached, gl.wrapped.IsUserInComputingGroup)
+}
+
+// isMember peeks at the entries so that the membership lookups are counted apart from the
+// lookups of the lists, an empty userKey is not looked at.
+func (gl *groupLooker) isMember(ctx context.Context, groupKey, uid, userKey, gid string, cached bool,
+	lookup func(ctx context.Context, uid, gid string, cached bool) (bool, error)) (bool, error) {
+	if cached {
+		if uids, ok := gl.peek(groupKey); ok {
+			gl.stats.Hit(cachestats.KindMembership)
+			return pkg.Contains(uids.([]string), uid), nil
+		}
+		if userKey != "" {
+			if gids, ok := gl.peek(userKey); ok {
+				gl.stats.Hit(cachestats.KindMembership)
+				return pkg.Contains(gids.([]string), gid), nil
+			}
+		}
+		gl.stats.Miss(cachestats.KindMembership)
+	} else {
+		gl.stats.Refresh(cachestats.KindMembership)
+	}
+
+	start := time.Now()
+	ok, err := lookup(ctx, uid, gid, false)
+	gl.stats.ObserveLDAP(cachestats.KindMembership, time.Since(start))
+	return ok, err
+}
+
+// get returns the cached value for key and counts the lookup as a hit, a miss
+// or a stale hit (expired but not yet removed by the janitor).
+func (gl *groupLooker) get(kind cachestats.Kind, key string) (interface{}, bool) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	el, ok := gl.items[key]
+	if !ok {
+		gl.stats.Miss(kind)
+		return nil, false
+	}
+	it := el.Value.(*item)
+	if !gl.now().Before(it.expires) {
+		gl.stats.StaleHit(kind)
+		return nil, false
+	}
+	gl.stats.Hit(kind)
+	return it.value, true
+}
+
+// peek returns the cached value for key like get, without counting the lookup.
+func (gl *groupLooker) peek(key string) (interface{}, bool) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	el, ok := gl.items[key]
+	if !ok {
+		return nil, false
+	}
+	it := el.Value.(*item)
+	if !gl.now().Before(it.expires) {
+		return nil, false
+	}
+	return it.value, true
+}
+
+func (gl *groupLooker) set(key string, value interface{}) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	it := &item{
+		key:     key,
+		expires: gl.now().Add(gl.expiration()),
+		value:   value,
+	}
+
+	if el, ok := gl.items[key]; ok {
+		el.Value = it
+		gl.order.MoveToBack(el)
+		return
+	}
+
+	if gl.maxEntries > 0 {
+		for gl.order.Len() >= gl.maxEntries {
+			gl.remove(gl.order.Front())
+		}
+	}
+	gl.items[key] = gl.order.PushBack(it)
+}
+
+// getTTL mimics the Redis TTL command: -2s is returned when the key does not exist
+// or has already expired.
+func (gl *groupLooker) getTTL(key string) time.Duration {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	el, ok := gl.items[key]
+	if !ok {
+		return time.Duration(-2) * time.Second
+	}
+	ttl := el.Value.(*item).expires.Sub(gl.now())
+	if ttl <= 0 {
+		return time.Duration(-2) * time.Second
+	}
+	return ttl
+}
+
+// purge removes all the expired entries.
+func (gl *groupLooker) purge() {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	now := gl.now()
+	for el := gl.order.Front(); el != nil; el = gl.order.Front() {
+		if now.Before(el.Value.(*item).expires) {
+			return
+		}
+		gl.remove(el)
+	}
+}
+
+func (gl *groupLooker) remove(el *list.Element) {
+	gl.order.Remove(el)
+	delete(gl.items, el.Value.(*item).key)
+}
+
+func (gl *groupLooker) janitor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			gl.purge()
+		case <-gl.done:
+			return
+		}
+	}
+}
+
+func copyStrings(in []string) []string {
+	if in == nil {
+		return nil
+	}
+	out := make([]string, len(in))
+	copy(out, in)
+	return out
+}
+
+func copyEntries(in []*pkg.SearchEntry) []*pkg.SearchEntry {
+	if in == nil {
+		return nil
+	}
+	out := make([]*pkg.SearchEntry, len(in))
+	for i, e := range in {
+		c := *e
+		out[i] = &c
+	}
+	return out
+}
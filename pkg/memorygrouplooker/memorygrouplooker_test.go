@@ -0,0 +1,197 @@
+package memorygrouplooker
+
+import (
+	"context"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/cachestats"
+	"testing"
+	"time"
+)
+
+type fakeLooker struct {
+	calls int
+}
+
+func (f *fakeLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"hugo", "labkode"}, nil
+}
+func (f *fakeLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"cernbox-admins"}, nil
+}
+func (f *fakeLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"hugo"}, nil
+}
+func (f *fakeLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"zp"}, nil
+}
+func (f *fakeLooker) GetTTLForUser(ctx context.Context, uid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) GetTTLForGroup(ctx context.Context, gid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) GetTTLForComputingUser(ctx context.Context, uid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) GetTTLForComputingGroup(ctx context.Context, gid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) Search(ctx context.Context, filter string, cached bool) ([]*pkg.SearchEntry, error) {
+	f.calls++
+	return []*pkg.SearchEntry{{CN: filter}}, nil
+}
+
+func (f *fakeLooker) IsUserInGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	f.calls++
+	return uid == "hugo", nil
+}
+func (f *fakeLooker) IsUserInComputingGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	f.calls++
+	return uid == "hugo", nil
+}
+
+func newTestLooker(ttl, maxEntries int) (*groupLooker, *fakeLooker, *time.Time) {
+	fake := &fakeLooker{}
+	gl := New(ttl, maxEntries, 0, fake).(*groupLooker)
+	now := time.Now()
+	gl.now = func() time.Time { return now }
+	return gl, fake, &now
+}
+
+func TestCacheHit(t *testing.T) {
+	ctx := context.Background()
+	gl, fake, _ := newTestLooker(60, 10)
+
+	for i := 0; i < 3; i++ {
+		uids, err := gl.GetUsersInGroup(ctx, "cernbox-admins", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(uids) != 2 {
+			t.Fatalf("expected 2 uids, got %v", uids)
+		}
+	}
+	if fake.calls != 1 {
+		t.Errorf("expected 1 call to the wrapped looker, got %d", fake.calls)
+	}
+
+	// not cached lookups always go to the wrapped looker
+	gl.GetUsersInGroup(ctx, "cernbox-admins", false)
+	if fake.calls != 2 {
+		t.Errorf("expected 2 calls to the wrapped looker, got %d", fake.calls)
+	}
+
+	stats := gl.Stats().Snapshot().Kinds[cachestats.KindGroup]
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Refreshes != 1 || stats.LDAPLookups != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	ctx := context.Background()
+	gl, fake, now := newTestLooker(60, 10)
+
+	gl.GetUserGroups(ctx, "hugo", true)
+	ttl, _ := gl.GetTTLForUser(ctx, "hugo")
+	if ttl != 60*time.Second {
+		t.Errorf("expected ttl of 60s, got %s", ttl)
+	}
+
+	*now = now.Add(61 * time.Second)
+	ttl, _ = gl.GetTTLForUser(ctx, "hugo")
+	if ttl != -2*time.Second {
+		t.Errorf("expected ttl of -2s for expired entry, got %s", ttl)
+	}
+
+	gl.GetUserGroups(ctx, "hugo", true)
+	if fake.calls != 2 {
+		t.Errorf("expected expired entry to be refreshed, got %d calls", fake.calls)
+	}
+	if stale := gl.Stats().Snapshot().Kinds[cachestats.KindUser].StaleHits; stale != 1 {
+		t.Errorf("expected 1 stale hit, got %d", stale)
+	}
+
+	*now = now.Add(61 * time.Second)
+	gl.purge()
+	if len(gl.items) != 0 || gl.order.Len() != 0 {
+		t.Errorf("expected empty cache after purge, got %d entries", len(gl.items))
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	gl, fake, _ := newTestLooker(60, 2)
+
+	gl.Search(ctx, "a", true)
+	gl.Search(ctx, "b", true)
+	gl.Search(ctx, "c", true)
+	if len(gl.items) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(gl.items))
+	}
+
+	// "a" is the oldest entry so it must have been evicted
+	gl.Search(ctx, "c", true)
+	if fake.calls != 3 {
+		t.Errorf("expected c to be cached, got %d calls", fake.calls)
+	}
+	gl.Search(ctx, "a", true)
+	if fake.calls != 4 {
+		t.Errorf("expected a to be evicted, got %d calls", fake.calls)
+	}
+}
+
+func TestIsMember(t *testing.T) {
+	ctx := context.Background()
+	gl, fake, _ := newTestLooker(60, 10)
+
+	// nothing cached, asked to the wrapped looker without caching the answer
+	for i := 0; i < 2; i++ {
+		if ok, _ := gl.IsUserInGroup(ctx, "hugo", "cernbox-admins", true); !ok {
+			t.Error("expected hugo to be a member")
+		}
+	}
+	if fake.calls != 2 {
+		t.Errorf("expected 2 calls to the wrapped looker, got %d", fake.calls)
+	}
+
+	// answered from the cached members of the group
+	gl.GetUsersInGroup(ctx, "cernbox-admins", true)
+	if ok, _ := gl.IsUserInGroup(ctx, "labkode", "cernbox-admins", true); !ok {
+		t.Error("expected labkode to be a member")
+	}
+	if ok, _ := gl.IsUserInGroup(ctx, "nobody", "cernbox-admins", true); ok {
+		t.Error("expected nobody not to be a member")
+	}
+
+	// answered from the cached groups of the user, they include the nested ones
+	gl.GetUserGroups(ctx, "labkode", true)
+	if ok, _ := gl.IsUserInGroup(ctx, "labkode", "it-dep", true); ok {
+		t.Error("expected labkode not to be in it-dep")
+	}
+	if fake.calls != 4 {
+		t.Errorf("expected cached answers, got %d calls", fake.calls)
+	}
+
+	// the cached computing groups of the user are only the direct ones, the wrapped looker is asked
+	gl.GetUserComputingGroups(ctx, "labkode", true)
+	gl.IsUserInComputingGroup(ctx, "labkode", "zp", true)
+	if fake.calls != 6 {
+		t.Errorf("expected the wrapped looker to be asked, got %d calls", fake.calls)
+	}
+	gl.GetUsersInComputingGroup(ctx, "zp", true)
+	if ok, _ := gl.IsUserInComputingGroup(ctx, "hugo", "zp", true); !ok {
+		t.Error("expected hugo to be in zp")
+	}
+	if fake.calls != 7 {
+		t.Errorf("expected a cached answer, got %d calls", fake.calls)
+	}
+
+	stats := gl.Stats().Snapshot().Kinds[cachestats.KindMembership]
+	if stats.Hits != 4 || stats.Misses != 3 || stats.LDAPLookups != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
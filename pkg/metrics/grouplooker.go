@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"time"
+)
+
+// NewGroupLooker wraps a GroupLooker, usually the LDAP one, recording the duration
+// and the errors of every lookup.
+func NewGroupLooker(wrapped pkg.GroupLooker) pkg.GroupLooker {
+	return &groupLooker{wrapped: wrapped}
+}
+
+type groupLooker struct {
+	wrapped pkg.GroupLooker
+}
+
+// observe records a lookup. Unknown users and groups are answers, not errors of LDAP.
+func observe(method string, start time.Time, err error) {
+	LDAPDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, pkg.ErrNotFound) {
+		LDAPErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (gl *groupLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	start := time.Now()
+	uids, err := gl.wrapped.GetUsersInGroup(ctx, gid, cached)
+	observe("GetUsersInGroup", start, err)
+	return uids, err
+}
+
+func (gl *groupLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	start := time.Now()
+	gids, err := gl.wrapped.GetUserGroups(ctx, uid, cached)
+	observe("GetUserGroups", start, err)
+	return gids, err
+}
+
+func (gl *groupLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	start := time.Now()
+	uids, err := gl.wrapped.GetUsersInComputingGroup(ctx, gid, cached)
+	observe("GetUsersInComputingGroup", start, err)
+	return uids, err
+}
+
+func (gl *groupLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	start := time.Now()
+	gids, err := gl.wrapped.GetUserComputingGroups(ctx, uid, cached)
+	observe("GetUserComputingGroups", start, err)
+	return gids, err
+}
+
+func (gl *groupLooker) Search(ctx context.Context, filter string, cached bool) ([]*pkg.SearchEntry, error) {
+	start := time.Now()
+	entries, err := gl.wrapped.Search(ctx, filter, cached)
+	observe("Search", start, err)
+	return entries, err
+}
+
+func (gl *groupLooker) IsUserInGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	start := time.Now()
+	ok, err := gl.wrapped.IsUserInGroup(ctx, uid, gid, cached)
+	observe("IsUserInGroup", start, err)
+	return ok, err
+}
+
+func (gl *groupLooker) IsUserInComputingGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	start := time.Now()
+	ok, err := gl.wrapped.IsUserInComputingGroup(ctx, uid, gid, cached)
+	observe("IsUserInComputingGroup", start, err)
+	return ok, err
+}
+
+func (gl *groupLooker) GetTTLForUser(ctx context.Context, uid string) (time.Duration, error) {
+	return gl.wrapped.GetTTLForUser(ctx, uid)
+}
+
+func (gl *groupLooker) GetTTLForGroup(ctx context.Context, gid string) (time.Duration, error) {
+	return gl.wrapped.GetTTLForGroup(ctx, gid)
+}
+
+func (gl *groupLooker) GetTTLForComputingUser(ctx context.Context, uid string) (time.Duration, error) {
+	return gl.wrapped.GetTTLForComputingUser(ctx, uid)
+}
+
+func (gl *groupLooker) GetTTLForComputingGroup(ctx context.Context, gid string) (time.Duration, error) {
+	return gl.wrapped.GetTTLForComputingGroup(ctx, gid)
+}
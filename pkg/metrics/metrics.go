@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cboxgroupd",
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cboxgroupd",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	LDAPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cboxgroupd",
+		Name:      "ldap_query_duration_seconds",
+		Help:      "Duration of LDAP lookups by GroupLooker method.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"method"})
+
+	LDAPErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cboxgroupd",
+		Name:      "ldap_query_errors_total",
+		Help:      "Number of failed LDAP lookups by GroupLooker method.",
+	}, []string{"method"})
+
+	RedisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cboxgroupd",
+		Name:      "redis_roundtrip_duration_seconds",
+		Help:      "Round-trip time of Redis commands.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 14),
+	}, []string{"command"})
+
+	UpdateJobsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cboxgroupd",
+		Name:      "update_jobs_in_flight",
+		Help:      "Number of asynchronous update jobs running.",
+	})
+
+	UpdateQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cboxgroupd",
+		Name:      "update_queue_length",
+		Help:      "Number of groups or users waiting in the update queue.",
+	})
+
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cboxgroupd",
+		Name:      "auth_failures_total",
+		Help:      "Authentication failures by reason (missing, unknown, expired, blocked).",
+	}, []string{"reason"})
+
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cboxgroupd",
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests answered 429 by the rate limits, by client with limits of its own (* for the others) and route family.",
+	}, []string{"client", "route"})
+
+	MembershipListSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cboxgroupd",
+		Name:      "membership_list_size",
+		Help:      "Number of elements of the returned membership lists.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 9),
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(HTTPRequests, HTTPDuration, LDAPDuration, LDAPErrors, RedisDuration, UpdateJobsInFlight, UpdateQueueLength, AuthFailures, RateLimited, MembershipListSize)
+}
+
+// ObserveRedis records the round-trip time of a Redis command started at start.
+func ObserveRedis(command string, start time.Time) {
+	RedisDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+}
+
+// InstrumentRoutes is a mux middleware that counts and times the requests
+// using the path template of the matched route as label.
+func InstrumentRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		start := time.Now()
+		rec := NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		HTTPDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.Status)).Inc()
+	})
+}
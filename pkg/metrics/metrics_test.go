@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeLooker answers the membership lookups with err, the other methods are not used.
+type fakeLooker struct {
+	pkg.GroupLooker
+	err error
+}
+
+func (l *fakeLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	return []string{"cernbox-admins"}, l.err
+}
+
+func (l *fakeLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	return []string{"alice"}, l.err
+}
+
+// samples returns the number of observations of a histogram.
+func samples(t *testing.T, o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	if err := o.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestGroupLooker(t *testing.T) {
+	looker := &fakeLooker{}
+	gl := NewGroupLooker(looker)
+	ctx := context.Background()
+
+	// the metrics are global, only their changes are checked
+	duration := func(method string) uint64 { return samples(t, LDAPDuration.WithLabelValues(method)) }
+	errs := func(method string) float64 { return testutil.ToFloat64(LDAPErrors.WithLabelValues(method)) }
+	groupsDuration, groupsErrors := duration("GetUserGroups"), errs("GetUserGroups")
+	usersDuration, usersErrors := duration("GetUsersInGroup"), errs("GetUsersInGroup")
+
+	if gids, err := gl.GetUserGroups(ctx, "alice", false); err != nil || len(gids) != 1 {
+		t.Fatalf("expected the answer of the wrapped looker, got %v %v", gids, err)
+	}
+	looker.err = errors.New("ldap down")
+	if _, err := gl.GetUserGroups(ctx, "alice", false); err != looker.err {
+		t.Fatalf("expected the error of the wrapped looker, got %v", err)
+	}
+	looker.err = fmt.Errorf("group cernbox-nope: %w", pkg.ErrNotFound)
+	if _, err := gl.GetUsersInGroup(ctx, "cernbox-nope", false); !errors.Is(err, pkg.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if n := duration("GetUserGroups") - groupsDuration; n != 2 {
+		t.Errorf("expected 2 GetUserGroups durations, got %d", n)
+	}
+	if n := errs("GetUserGroups") - groupsErrors; n != 1 {
+		t.Errorf("expected 1 GetUserGroups error, got %v", n)
+	}
+	if n := duration("GetUsersInGroup") - usersDuration; n != 1 {
+		t.Errorf("expected 1 GetUsersInGroup duration, got %d", n)
+	}
+	if n := errs("GetUsersInGroup") - usersErrors; n != 0 {
+		t.Errorf("expected an unknown group not to count as an error, got %v", n)
+	}
+}
+
+func TestInstrumentRoutes(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(InstrumentRoutes)
+	router.HandleFunc("/api/v1/usergroups/{uid}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["uid"] == "nobody" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("[]"))
+	}).Methods("GET")
+
+	route := "/api/v1/usergroups/{uid}"
+	requests := func(code string) float64 { return testutil.ToFloat64(HTTPRequests.WithLabelValues(route, "GET", code)) }
+	ok, notFound := requests("200"), requests("404")
+	timed := samples(t, HTTPDuration.WithLabelValues(route, "GET"))
+
+	for _, path := range []string{"/api/v1/usergroups/alice", "/api/v1/usergroups/bob", "/api/v1/usergroups/nobody"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	if n := requests("200") - ok; n != 2 {
+		t.Errorf("expected 2 requests answered 200 counted under the route template, got %v", n)
+	}
+	if n := requests("404") - notFound; n != 1 {
+		t.Errorf("expected 1 request answered 404, got %v", n)
+	}
+	if n := samples(t, HTTPDuration.WithLabelValues(route, "GET")) - timed; n != 3 {
+		t.Errorf("expected 3 durations, got %d", n)
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := NewStatusRecorder(w)
+	if rec.Status != http.StatusOK {
+		t.Errorf("expected 200 before WriteHeader, got %d", rec.Status)
+	}
+
+	rec.WriteHeader(http.StatusTeapot)
+	rec.Write([]byte("short"))
+	rec.Write([]byte(" and stout"))
+	if rec.Status != http.StatusTeapot || w.Code != http.StatusTeapot {
+		t.Errorf("expected the status to be recorded and passed on, got %d and %d", rec.Status, w.Code)
+	}
+	if rec.Size != len("short and stout") || w.Body.String() != "short and stout" {
+		t.Errorf("expected the size of the body to be recorded, got %d for %q", rec.Size, w.Body.String())
+	}
+}
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"net/http"
+)
+
+// StatusRecorder is a ResponseWriter remembering the status and the size of the response,
+// for the middlewares that report them.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+	Size   int
+}
+
+// NewStatusRecorder wraps w, the status is 200 until WriteHeader is called.
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *StatusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.Size += n
+	return n, err
+}
@@ -28,7 +28,13 @@ type SearchEntry struct {
 type GroupLookerErrorCode string
 
 const (
-	GroupLookerErrorNotFound GroupLookerErrorCode = "GROUPLOOKER_ERROR_NOT_FOUND"
+	GroupLookerErrorNotFound         GroupLookerErrorCode = "GROUPLOOKER_ERROR_NOT_FOUND"
+	GroupLookerErrorInvalidArgument  GroupLookerErrorCode = "GROUPLOOKER_ERROR_INVALID_ARGUMENT"
+	GroupLookerErrorUnavailable      GroupLookerErrorCode = "GROUPLOOKER_ERROR_UNAVAILABLE"
+	GroupLookerErrorTimeout          GroupLookerErrorCode = "GROUPLOOKER_ERROR_TIMEOUT"
+	GroupLookerErrorLimitExceeded    GroupLookerErrorCode = "GROUPLOOKER_ERROR_LIMIT_EXCEEDED"
+	GroupLookerErrorTooLarge         GroupLookerErrorCode = "GROUPLOOKER_ERROR_TOO_LARGE"
+	GroupLookerErrorPermissionDenied GroupLookerErrorCode = "GROUPLOOKER_ERROR_PERMISSION_DENIED"
 )
 
 func NewGroupLookerError(code GroupLookerErrorCode) GroupLookerError {
@@ -38,6 +44,8 @@ func NewGroupLookerError(code GroupLookerErrorCode) GroupLookerError {
 type GroupLookerError struct {
 	Code    GroupLookerErrorCode
 	Message string
+	// Cause is the error of the backend, if any. It is not shown to the clients.
+	Cause error
 }
 
 func (sr GroupLookerError) WithMessage(msg string) GroupLookerError {
@@ -45,10 +53,33 @@ func (sr GroupLookerError) WithMessage(msg string) GroupLookerError {
 	return sr
 }
 
+// WithCause wraps the error of the backend, it is returned by errors.Unwrap.
+func (sr GroupLookerError) WithCause(err error) GroupLookerError {
+	sr.Cause = err
+	return sr
+}
+
 func (sr GroupLookerError) Error() string {
+	if sr.Cause != nil {
+		return fmt.Sprintf("%s: %s: %s", sr.Code, sr.Message, sr.Cause)
+	}
 	return fmt.Sprintf("%s: %s", sr.Code, sr.Message)
 }
 
+func (sr GroupLookerError) Unwrap() error {
+	return sr.Cause
+}
+
+// Is matches the GroupLookerErrors with the same code, so that
+// errors.Is(err, ErrNotFound) tells whether err is a not found error.
+func (sr GroupLookerError) Is(target error) bool {
+	t, ok := target.(GroupLookerError)
+	return ok && t.Code == sr.Code
+}
+
+// ErrNotFound matches with errors.Is the errors of unknown users and groups.
+var ErrNotFound = NewGroupLookerError(GroupLookerErrorNotFound)
+
 type GroupLooker interface {
 	GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error)
 	GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error)
@@ -59,4 +90,24 @@ type GroupLooker interface {
 	GetTTLForComputingUser(ctx context.Context, uid string) (time.Duration, error)
 	GetTTLForComputingGroup(ctx context.Context, gid string) (time.Duration, error)
 	Search(ctx context.Context, filter string, cached bool) ([]*SearchEntry, error)
+	// IsUserInGroup and IsUserInComputingGroup tell whether uid is a member of gid, also through nested groups.
+	IsUserInGroup(ctx context.Context, uid, gid string, cached bool) (bool, error)
+	IsUserInComputingGroup(ctx context.Context, uid, gid string, cached bool) (bool, error)
+}
+
+// Contains tells whether list has s, the cache backends use it to answer
+// IsUserInGroup from a cached list of members or groups.
+func Contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Pinger is implemented by the GroupLookers that depend on an external service,
+// to check that the service is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
 }
@@ -0,0 +1,29 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestGroupLookerErrorWrapping(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := fmt.Errorf("lookup: %w", NewGroupLookerError(GroupLookerErrorUnavailable).WithMessage("LDAP server unavailable").WithCause(cause))
+
+	if !errors.Is(err, NewGroupLookerError(GroupLookerErrorUnavailable)) {
+		t.Error("errors.Is does not match the code")
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Error("errors.Is matches another code")
+	}
+	if !errors.Is(err, cause) {
+		t.Error("errors.Is does not find the cause")
+	}
+	var gle GroupLookerError
+	if !errors.As(err, &gle) || gle.Code != GroupLookerErrorUnavailable || gle.Message != "LDAP server unavailable" {
+		t.Errorf("errors.As: unexpected %+v", gle)
+	}
+	if got := gle.Error(); got != "GROUPLOOKER_ERROR_UNAVAILABLE: LDAP server unavailable: connection refused" {
+		t.Errorf("unexpected message %q", got)
+	}
+}
@@ -0,0 +1,119 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+)
+
+// Route families a policy can allow.
+const (
+	Membership = "membership"
+	Search     = "search"
+	Update     = "update"
+	Admin      = "admin"
+)
+
+var families = map[string]bool{Membership: true, Search: true, Update: true, Admin: true}
+
+// AnyClient is the client of the policy applied to the clients without their own.
+const AnyClient = "*"
+
+// Policy restricts a client to some route families and, if Groups is not empty,
+// to the groups whose name matches one of its patterns (path.Match syntax, e.g. cernbox-*).
+type Policy struct {
+	Client string
+	Routes []string
+	Groups []string
+}
+
+// AllowsRoute tells whether the client can use the routes of family.
+func (p *Policy) AllowsRoute(family string) bool {
+	for _, r := range p.Routes {
+		if r == family {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsGroup tells whether the client can see the group gid.
+func (p *Policy) AllowsGroup(gid string) bool {
+	if len(p.Groups) == 0 {
+		return true
+	}
+	for _, pattern := range p.Groups {
+		if ok, _ := path.Match(pattern, gid); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Policies holds the policy of every restricted client.
+// Clients without a policy get the one of AnyClient, if any, else they are not restricted.
+type Policies struct {
+	mu       sync.RWMutex
+	policies map[string]*Policy
+}
+
+// New returns the given policies.
+func New(policies []Policy) (*Policies, error) {
+	p := &Policies{}
+	if err := p.Set(policies); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate checks that every policy names a client once, known route families and valid patterns.
+func Validate(policies []Policy) error {
+	seen := map[string]bool{}
+	for _, p := range policies {
+		if p.Client == "" {
+			return errors.New("policy without client")
+		}
+		if seen[p.Client] {
+			return fmt.Errorf("client %s has two policies", p.Client)
+		}
+		seen[p.Client] = true
+		for _, r := range p.Routes {
+			if !families[r] {
+				return fmt.Errorf("unknown routes %q in the policy of client %s", r, p.Client)
+			}
+		}
+		for _, g := range p.Groups {
+			if _, err := path.Match(g, ""); err != nil {
+				return fmt.Errorf("invalid group pattern %q in the policy of client %s", g, p.Client)
+			}
+		}
+	}
+	return nil
+}
+
+// Set replaces the policies. If any of them is invalid the previous ones are kept.
+func (p *Policies) Set(policies []Policy) error {
+	if err := Validate(policies); err != nil {
+		return err
+	}
+	m := map[string]*Policy{}
+	for i := range policies {
+		m[policies[i].Client] = &policies[i]
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policies = m
+	return nil
+}
+
+// Get returns the policy of client or the one of AnyClient, nil if it is not restricted.
+func (p *Policies) Get(client string) *Policy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if policy, ok := p.policies[client]; ok {
+		return policy
+	}
+	return p.policies[AnyClient]
+}
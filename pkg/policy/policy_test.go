@@ -0,0 +1,58 @@
+package policy
+
+import "testing"
+
+func TestPolicies(t *testing.T) {
+	p, err := New([]Policy{{Client: "web", Routes: []string{Membership, Search}, Groups: []string{"cernbox-*", "it-dep"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Get("sync") != nil {
+		t.Error("client without policy is restricted")
+	}
+	web := p.Get("web")
+	if web == nil {
+		t.Fatal("policy of web not found")
+	}
+	if !web.AllowsRoute(Membership) || web.AllowsRoute(Update) || web.AllowsRoute(Admin) {
+		t.Errorf("unexpected routes allowed: %v", web.Routes)
+	}
+	for gid, allowed := range map[string]bool{"cernbox-admins": true, "it-dep": true, "it-dep-db": false, "cernbox": false} {
+		if web.AllowsGroup(gid) != allowed {
+			t.Errorf("%s: expected allowed=%t", gid, allowed)
+		}
+	}
+	if !(&Policy{Client: "any"}).AllowsGroup("whatever") {
+		t.Error("policy without groups does not allow every group")
+	}
+
+	// the clients without their own policy, like the subjects of the JWTs, get the one of *
+	p.Set([]Policy{{Client: "web", Routes: []string{Membership}}, {Client: AnyClient, Routes: []string{Search}}})
+	if sync := p.Get("sync"); sync == nil || !sync.AllowsRoute(Search) || sync.AllowsRoute(Membership) {
+		t.Errorf("expected the policy of * for sync, got %+v", sync)
+	}
+	if web := p.Get("web"); web == nil || !web.AllowsRoute(Membership) || web.AllowsRoute(Search) {
+		t.Errorf("expected the own policy of web, got %+v", web)
+	}
+}
+
+func TestSetInvalid(t *testing.T) {
+	p, err := New([]Policy{{Client: "web", Routes: []string{Membership}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := [][]Policy{
+		{{Routes: []string{Membership}}},
+		{{Client: "web"}, {Client: "web"}},
+		{{Client: "web", Routes: []string{"memberships"}}},
+		{{Client: "web", Groups: []string{"cernbox-["}}},
+	}
+	for _, policies := range invalid {
+		if err := p.Set(policies); err == nil {
+			t.Errorf("%+v: expected error", policies)
+		}
+	}
+	if web := p.Get("web"); web == nil || !web.AllowsRoute(Membership) {
+		t.Error("previous policies not kept")
+	}
+}
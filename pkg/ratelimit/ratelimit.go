@@ -0,0 +1,203 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Any matches every client or route in a Limit.
+const Any = "*"
+
+// Limit allows a client Rate requests per second on a route family, with bursts of up to
+// Burst requests. Client and Route can be Any.
+type Limit struct {
+	Client string
+	Route  string
+	Rate   float64
+	Burst  int
+}
+
+// Result is the state of the bucket of a client after a request.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, zero if it is allowed now.
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets of the clients.
+type Store interface {
+	// Take takes a token from the bucket key with the given limit.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Limiter applies to every client and route the most specific of its limits:
+// the one for the client and the route, then for the client, then for the route, then for any.
+type Limiter struct {
+	store Store
+
+	mu     sync.RWMutex
+	limits map[[2]string]Limit
+}
+
+// New returns a Limiter keeping its buckets in store.
+func New(store Store, limits []Limit) (*Limiter, error) {
+	l := &Limiter{store: store}
+	if err := l.Set(limits); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Validate checks that the limits are positive and that no client and route have two limits.
+func Validate(limits []Limit) error {
+	seen := map[[2]string]bool{}
+	for _, limit := range limits {
+		if limit.Client == "" || limit.Route == "" {
+			return errors.New("rate limit without client or route, use * for any")
+		}
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return fmt.Errorf("rate limit of client %s on route %s must have a positive rate and burst", limit.Client, limit.Route)
+		}
+		key := [2]string{limit.Client, limit.Route}
+		if seen[key] {
+			return fmt.Errorf("client %s has two rate limits on route %s", limit.Client, limit.Route)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// Set replaces the limits. If any of them is invalid the previous ones are kept.
+func (l *Limiter) Set(limits []Limit) error {
+	if err := Validate(limits); err != nil {
+		return err
+	}
+	m := map[[2]string]Limit{}
+	for _, limit := range limits {
+		m[[2]string{limit.Client, limit.Route}] = limit
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = m
+	return nil
+}
+
+// Allow takes a token from the bucket of client on route. ok is false if there is no
+// limit for them.
+func (l *Limiter) Allow(ctx context.Context, client, route string) (res Result, ok bool, err error) {
+	limit, ok := l.limit(client, route)
+	if !ok {
+		return Result{Allowed: true}, false, nil
+	}
+	res, err = l.store.Take(ctx, client+":"+route, limit)
+	return res, true, err
+}
+
+// Label returns client if it has limits of its own and Any otherwise, so that the
+// metrics have a label per configured client and not per JWT subject or typo.
+func (l *Limiter) Label(client string) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for key := range l.limits {
+		if key[0] == client {
+			return client
+		}
+	}
+	return Any
+}
+
+func (l *Limiter) limit(client, route string) (Limit, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, key := range [][2]string{{client, route}, {client, Any}, {Any, route}, {Any, Any}} {
+		if limit, ok := l.limits[key]; ok {
+			return limit, true
+		}
+	}
+	return Limit{}, false
+}
+
+// NewMemoryStore returns a Store with token buckets in memory, the limits apply to
+// each instance of cboxgroupd on its own.
+func NewMemoryStore() Store {
+	return &memoryStore{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+	now     func() time.Time
+}
+
+func (s *memoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.prune(now)
+
+	b, ok := s.buckets[key]
+	if !ok || b.limit != limit {
+		// new client or limit changed by a reload
+		b = &bucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		s.buckets[key] = b
+	}
+	b.fill(now)
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return result(limit, b.tokens, allowed), nil
+}
+
+// result is the state of a bucket of limit left with tokens after a request.
+func result(limit Limit, tokens float64, allowed bool) Result {
+	res := Result{Allowed: allowed, Limit: limit.Burst, Remaining: int(tokens)}
+	if !allowed {
+		res.RetryAfter = seconds((1 - tokens) / limit.Rate)
+	}
+	res.Reset = seconds((float64(limit.Burst) - tokens) / limit.Rate)
+	return res
+}
+
+func (b *bucket) fill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if max := float64(b.limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// prune removes once a minute the buckets that are full, they are the same as new ones.
+func (s *memoryStore) prune(now time.Time) {
+	if now.Sub(s.pruned) < time.Minute {
+		return
+	}
+	s.pruned = now
+	for key, b := range s.buckets {
+		b.fill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := &memoryStore{buckets: map[string]*bucket{}, now: func() time.Time { return now }}
+	limit := Limit{Client: "web", Route: "search", Rate: 2, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		res, err := store.Take(context.Background(), "web:search", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed || res.Remaining != i || res.Limit != 3 {
+			t.Fatalf("request %d: unexpected result %+v", 3-i, res)
+		}
+	}
+	res, _ := store.Take(context.Background(), "web:search", limit)
+	if res.Allowed || res.RetryAfter != 500*time.Millisecond || res.Reset != 1500*time.Millisecond {
+		t.Fatalf("expected the fourth request to be limited, got %+v", res)
+	}
+
+	now = now.Add(time.Second)
+	res, _ = store.Take(context.Background(), "web:search", limit)
+	if !res.Allowed || res.Remaining != 1 {
+		t.Fatalf("expected two tokens after one second, got %+v", res)
+	}
+
+	// a changed limit starts with a full bucket
+	limit.Burst = 10
+	res, _ = store.Take(context.Background(), "web:search", limit)
+	if !res.Allowed || res.Remaining != 9 {
+		t.Fatalf("expected a new bucket for the new limit, got %+v", res)
+	}
+
+	now = now.Add(time.Hour)
+	store.Take(context.Background(), "other:search", limit)
+	if _, ok := store.buckets["web:search"]; ok {
+		t.Error("full bucket not pruned")
+	}
+}
+
+func TestLimiterPrecedence(t *testing.T) {
+	l, err := New(NewMemoryStore(), []Limit{
+		{Client: Any, Route: Any, Rate: 1, Burst: 1},
+		{Client: Any, Route: "search", Rate: 1, Burst: 2},
+		{Client: "web", Route: Any, Rate: 1, Burst: 3},
+		{Client: "web", Route: "search", Rate: 1, Burst: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client, route string
+		burst         int
+	}{
+		{"web", "search", 4},
+		{"web", "update", 3},
+		{"sync", "search", 2},
+		{"sync", "update", 1},
+	}
+	for _, test := range tests {
+		res, limited, err := l.Allow(context.Background(), test.client, test.route)
+		if err != nil || !limited || res.Limit != test.burst {
+			t.Errorf("%s on %s: expected burst %d, got %+v %t %v", test.client, test.route, test.burst, res, limited, err)
+		}
+	}
+
+	if label := l.Label("web"); label != "web" {
+		t.Errorf("expected the label of a client with its own limits, got %s", label)
+	}
+	if label := l.Label("jwt-subject"); label != Any {
+		t.Errorf("expected %s for a client without limits, got %s", Any, label)
+	}
+
+	if err := l.Set(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, limited, _ := l.Allow(context.Background(), "web", "search"); limited {
+		t.Error("limited without limits")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := [][]Limit{
+		{{Route: "search", Rate: 1, Burst: 1}},
+		{{Client: "web", Route: "search", Rate: 0, Burst: 1}},
+		{{Client: "web", Route: "search", Rate: 1, Burst: 0}},
+		{{Client: "web", Route: "search", Rate: 1, Burst: 1}, {Client: "web", Route: "search", Rate: 2, Burst: 2}},
+	}
+	for _, limits := range invalid {
+		if err := Validate(limits); err == nil {
+			t.Errorf("%+v: expected error", limits)
+		}
+	}
+}
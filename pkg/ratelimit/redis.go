@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/redis.v5"
+	"strconv"
+	"time"
+)
+
+// NewRedisStore returns a Store with token buckets in Redis, so the limits apply to all
+// the instances of cboxgroupd together. The bucket of a client on a route is the hash
+// ratelimit:<client>:<route>, updated by a script so concurrent requests do not race,
+// and expires once it is full again. The time is the one of the instance taking the token.
+func NewRedisStore(hostname string, port, db int, password string) Store {
+	client := redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%d", hostname, port),
+		DB:       db,
+		Password: password,
+	})
+	return &redisStore{client: client, now: time.Now}
+}
+
+type redisStore struct {
+	client *redis.Client
+	now    func() time.Time
+}
+
+// takeScript fills the bucket KEYS[1] for the time since its last request and takes a
+// token if there is one. ARGV are the rate, the burst and the time in seconds.
+// A bucket of another limit, changed by a reload, starts full like a new one.
+// The tokens are returned as a string, Redis would truncate a number.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "last", "rate", "burst")
+local tokens = burst
+if b[1] and b[3] == ARGV[1] and b[4] == ARGV[2] then
+	tokens = math.min(burst, tonumber(b[1]) + math.max(0, now - tonumber(b[2])) * rate)
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", ARGV[3], "rate", ARGV[1], "burst", ARGV[2])
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+func (s *redisStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := float64(s.now().UnixNano()) / float64(time.Second)
+	reply, err := takeScript.Run(s.client, []string{"ratelimit:" + key},
+		strconv.FormatFloat(limit.Rate, 'g', -1, 64), strconv.Itoa(limit.Burst), strconv.FormatFloat(now, 'f', 6, 64)).Result()
+	if err != nil {
+		return Result{}, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return Result{}, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	text, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("unexpected rate limit tokens %v", values[1])
+	}
+	return result(limit, tokens, allowed == 1), nil
+}
+
+// Close closes the connections to Redis.
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
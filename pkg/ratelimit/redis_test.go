@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/alicebob/miniredis"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRedisStore(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	port, _ := strconv.Atoi(s.Port())
+	store := NewRedisStore(s.Host(), port, 0, "").(*redisStore)
+	defer store.Close()
+	now := time.Unix(1000, 0)
+	store.now = func() time.Time { return now }
+	limit := Limit{Client: "web", Route: "search", Rate: 2, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		res, err := store.Take(context.Background(), "web:search", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed || res.Remaining != i || res.Limit != 3 {
+			t.Fatalf("request %d: unexpected result %+v", 3-i, res)
+		}
+	}
+	res, _ := store.Take(context.Background(), "web:search", limit)
+	if res.Allowed || res.RetryAfter != 500*time.Millisecond || res.Reset != 1500*time.Millisecond {
+		t.Fatalf("expected the fourth request to be limited, got %+v", res)
+	}
+	if ttl := s.TTL("ratelimit:web:search"); ttl != 2500*time.Millisecond {
+		t.Errorf("expected the bucket to expire once full, got %v", ttl)
+	}
+
+	// the bucket is refilled at the rate, not at the end of a window
+	now = now.Add(time.Second)
+	res, _ = store.Take(context.Background(), "web:search", limit)
+	if !res.Allowed || res.Remaining != 1 {
+		t.Fatalf("expected two tokens after one second, got %+v", res)
+	}
+	now = now.Add(250 * time.Millisecond)
+	res, _ = store.Take(context.Background(), "web:search", limit)
+	if !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("expected the half token to be kept, got %+v", res)
+	}
+
+	// a changed limit starts with a full bucket
+	limit.Burst = 10
+	res, _ = store.Take(context.Background(), "web:search", limit)
+	if !res.Allowed || res.Remaining != 9 {
+		t.Fatalf("expected a new bucket for the new limit, got %+v", res)
+	}
+
+	s.Close()
+	if _, err := store.Take(context.Background(), "web:search", limit); err == nil {
+		t.Error("expected an error without Redis")
+	}
+}
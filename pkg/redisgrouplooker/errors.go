@@ -0,0 +1,23 @@
+package redisgrouplooker
+
+import (
+	"context"
+	"errors"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"net"
+)
+
+// mapError turns the errors of the Redis client into GroupLookerErrors wrapping them.
+// It must only be called with errors of Redis, the ones of the wrapped GroupLooker
+// are returned as they are.
+func mapError(err error) error {
+	var gle pkg.GroupLookerError
+	if err == nil || errors.As(err, &gle) {
+		return err
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		return pkg.NewGroupLookerError(pkg.GroupLookerErrorTimeout).WithMessage("cache did not answer in time").WithCause(err)
+	}
+	return pkg.NewGroupLookerError(pkg.GroupLookerErrorUnavailable).WithMessage("cache unavailable").WithCause(err)
+}
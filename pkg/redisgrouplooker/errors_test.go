@@ -0,0 +1,35 @@
+package redisgrouplooker
+
+import (
+	"errors"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"net"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestMapError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code pkg.GroupLookerErrorCode
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, pkg.GroupLookerErrorUnavailable},
+		{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, pkg.GroupLookerErrorTimeout},
+		{errors.New("redis: client is closed"), pkg.GroupLookerErrorUnavailable},
+	}
+	for _, test := range tests {
+		err := mapError(test.err)
+		if !errors.Is(err, pkg.NewGroupLookerError(test.code)) || !errors.Is(err, test.err) {
+			t.Errorf("%v: expected %s wrapping it, got %v", test.err, test.code, err)
+		}
+	}
+
+	if err := mapError(pkg.ErrNotFound); !errors.Is(err, pkg.ErrNotFound) || errors.Is(err, pkg.NewGroupLookerError(pkg.GroupLookerErrorUnavailable)) {
+		t.Errorf("error of the wrapped looker changed: %v", err)
+	}
+}
@@ -5,10 +5,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/cachestats"
+	"github.com/cernbox/cboxgroupd/pkg/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/redis.v5"
+	"sync/atomic"
 	"time"
 )
 
+var tracer = otel.Tracer("github.com/cernbox/cboxgroupd/pkg/redisgrouplooker")
+
 // redisgrouplooker is a wrapper around any GroupLooker that will cache
 // resglts for a given TTL.
 // If the query cannot be found in the cache, it will call the wrapped GroupLooker
@@ -20,16 +29,70 @@ func New(hostname string, port, db, ttl int, password string, wrapped pkg.GroupL
 		Password: password,
 	})
 	return &groupLooker{
-		ttl:     ttl,
+		ttl:     int64(ttl),
 		client:  client,
 		wrapped: wrapped,
+		stats:   cachestats.New(),
 	}
 }
 
 type groupLooker struct {
-	ttl     int
+	ttl     int64
 	client  *redis.Client
 	wrapped pkg.GroupLooker
+	stats   *cachestats.Stats
+}
+
+// Stats returns the hit/miss counters of the cache.
+// Redis removes expired keys by itself, so stale hits are never reported.
+func (gl *groupLooker) Stats() *cachestats.Stats {
+	return gl.stats
+}
+
+// SetTTL changes the TTL of the entries cached from now on, the existing ones keep theirs.
+func (gl *groupLooker) SetTTL(ttl int) {
+	atomic.StoreInt64(&gl.ttl, int64(ttl))
+}
+
+func (gl *groupLooker) expiration() time.Duration {
+	return time.Second * time.Duration(atomic.LoadInt64(&gl.ttl))
+}
+
+// Close closes the connections to Redis.
+func (gl *groupLooker) Close() error {
+	return gl.client.Close()
+}
+
+// roundTrip starts timing a Redis command for the metrics and the traces,
+// the returned function must be called when the command finishes.
+func (gl *groupLooker) roundTrip(ctx context.Context, command string) func() {
+	_, span := tracer.Start(ctx, "redis."+command)
+	start := time.Now()
+	return func() {
+		metrics.ObserveRedis(command, start)
+		span.End()
+	}
+}
+
+// Ping checks that Redis answers.
+func (gl *groupLooker) Ping(ctx context.Context) error {
+	defer gl.roundTrip(ctx, "ping")()
+	return mapError(gl.client.Ping().Err())
+}
+
+func (gl *groupLooker) exists(ctx context.Context, key string) bool {
+	defer gl.roundTrip(ctx, "exists")()
+	return gl.client.Exists(key).Val()
+}
+
+func (gl *groupLooker) smembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	defer gl.roundTrip(ctx, "smembers")()
+	return gl.client.SMembers(key)
+}
+
+func (gl *groupLooker) get(ctx context.Context, key string) *redis.StringCmd {
+	defer gl.roundTrip(ctx, "get")()
+	return gl.client.Get(key)
 }
 
 // GetUsersInGroups returns the uids (users) members of the given gid
@@ -37,164 +100,243 @@ type groupLooker struct {
 // To query for all groups of a given user we query redis for the prefix hugo:*
 func (gl *groupLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
 	key := fmt.Sprintf("egroup:%s", gid)
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.GetUsersInGroup", trace.WithAttributes(attribute.String("gid", gid), attribute.Bool("cached", cached)))
+	defer span.End()
 
 	// check if it is cached
 	if cached {
-		if gl.client.Exists(key).Val() == true {
-			cmd := gl.client.SMembers(key)
+		if gl.exists(ctx, key) {
+			cmd := gl.smembers(ctx, key)
 			if cmd.Err() == nil {
 				uids, err := cmd.Result()
 				if err == nil {
+					gl.stats.Hit(cachestats.KindGroup)
+					span.SetAttributes(attribute.Bool("cache.hit", true))
 					return uids, nil
 				}
 			}
 		}
+		gl.stats.Miss(cachestats.KindGroup)
+	} else {
+		gl.stats.Refresh(cachestats.KindGroup)
 	}
 
-	uids, err := gl.wrapped.GetUsersInGroup(ctx, gid, false)
-	if err != nil {
-		return nil, err
-	}
-
-	pipeline := gl.client.TxPipeline()
-	defer pipeline.Close()
-	for _, uid := range uids {
-		pipeline.SAdd(key, uid)
-	}
-	pipeline.Expire(key, time.Second*time.Duration(gl.ttl))
-	_, err = pipeline.Exec()
-	if err != nil {
-		return nil, err
-	}
-	return uids, nil
+	return gl.fill(ctx, span, cachestats.KindGroup, key, gid, gl.wrapped.GetUsersInGroup)
 }
 
 func (gl *groupLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
 	key := fmt.Sprintf("unixgroup:%s", gid)
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.GetUsersInComputingGroup", trace.WithAttributes(attribute.String("gid", gid), attribute.Bool("cached", cached)))
+	defer span.End()
 
 	// check if it is cached
 	if cached {
-		if gl.client.Exists(key).Val() == true {
-			cmd := gl.client.SMembers(key)
+		if gl.exists(ctx, key) {
+			cmd := gl.smembers(ctx, key)
 			if cmd.Err() == nil {
 				uids, err := cmd.Result()
 				if err == nil {
+					gl.stats.Hit(cachestats.KindComputingGroup)
+					span.SetAttributes(attribute.Bool("cache.hit", true))
 					return uids, nil
 				}
 			}
 		}
+		gl.stats.Miss(cachestats.KindComputingGroup)
+	} else {
+		gl.stats.Refresh(cachestats.KindComputingGroup)
 	}
 
-	uids, err := gl.wrapped.GetUsersInComputingGroup(ctx, gid, false)
-	if err != nil {
-		return nil, err
-	}
-
-	pipeline := gl.client.TxPipeline()
-	defer pipeline.Close()
-	for _, uid := range uids {
-		pipeline.SAdd(key, uid)
-	}
-	pipeline.Expire(key, time.Second*time.Duration(gl.ttl))
-	_, err = pipeline.Exec()
-	if err != nil {
-		return nil, err
-	}
-	return uids, nil
+	return gl.fill(ctx, span, cachestats.KindComputingGroup, key, gid, gl.wrapped.GetUsersInComputingGroup)
 }
 
 func (gl *groupLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
 	key := fmt.Sprintf("u:%s", uid)
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.GetUserGroups", trace.WithAttributes(attribute.String("uid", uid), attribute.Bool("cached", cached)))
+	defer span.End()
 
 	// check if it is cached
 	if cached {
-		if gl.client.Exists(key).Val() == true {
-			cmd := gl.client.SMembers(key)
+		if gl.exists(ctx, key) {
+			cmd := gl.smembers(ctx, key)
 			if cmd.Err() == nil {
 				gids, err := cmd.Result()
 				if err == nil {
+					gl.stats.Hit(cachestats.KindUser)
+					span.SetAttributes(attribute.Bool("cache.hit", true))
 					return gids, nil
 				}
 			}
 		}
+		gl.stats.Miss(cachestats.KindUser)
+	} else {
+		gl.stats.Refresh(cachestats.KindUser)
 	}
 
-	gids, err := gl.wrapped.GetUserGroups(ctx, uid, false)
-	if err != nil {
-		return nil, err
-	}
-
-	pipeline := gl.client.TxPipeline()
-	defer pipeline.Close()
-	for _, gid := range gids {
-		pipeline.SAdd(key, gid)
-	}
-	pipeline.Expire(key, time.Second*time.Duration(gl.ttl))
-	_, err = pipeline.Exec()
-	if err != nil {
-		return nil, err
-	}
-	return gids, nil
+	return gl.fill(ctx, span, cachestats.KindUser, key, uid, gl.wrapped.GetUserGroups)
 }
 
 func (gl *groupLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
 	key := fmt.Sprintf("unixuser:%s", uid)
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.GetUserComputingGroups", trace.WithAttributes(attribute.String("uid", uid), attribute.Bool("cached", cached)))
+	defer span.End()
 
 	// check if it is cached
 	if cached {
-		if gl.client.Exists(key).Val() == true {
-			cmd := gl.client.SMembers(key)
+		if gl.exists(ctx, key) {
+			cmd := gl.smembers(ctx, key)
 			if cmd.Err() == nil {
 				gids, err := cmd.Result()
 				if err == nil {
+					gl.stats.Hit(cachestats.KindComputingUser)
+					span.SetAttributes(attribute.Bool("cache.hit", true))
 					return gids, nil
 				}
 			}
 		}
+		gl.stats.Miss(cachestats.KindComputingUser)
+	} else {
+		gl.stats.Refresh(cachestats.KindComputingUser)
 	}
 
-	gids, err := gl.wrapped.GetUserComputingGroups(ctx, uid, false)
+	return gl.fill(ctx, span, cachestats.KindComputingUser, key, uid, gl.wrapped.GetUserComputingGroups)
+}
+
+// fill looks up id with the wrapped GroupLooker and caches the list under key,
+// replacing the cached one so that the members removed in LDAP are removed too.
+func (gl *groupLooker) fill(ctx context.Context, span trace.Span, kind cachestats.Kind, key, id string,
+	lookup func(ctx context.Context, id string, cached bool) ([]string, error)) ([]string, error) {
+	start := time.Now()
+	list, err := lookup(ctx, id, false)
+	gl.stats.ObserveLDAP(kind, time.Since(start))
 	if err != nil {
+		recordError(span, err)
 		return nil, err
 	}
 
 	pipeline := gl.client.TxPipeline()
 	defer pipeline.Close()
-	for _, gid := range gids {
-		pipeline.SAdd(key, gid)
+	pipeline.Del(key)
+	for _, e := range list {
+		pipeline.SAdd(key, e)
 	}
-	pipeline.Expire(key, time.Second*time.Duration(gl.ttl))
+	pipeline.Expire(key, gl.expiration())
+	done := gl.roundTrip(ctx, "pipeline")
 	_, err = pipeline.Exec()
+	done()
 	if err != nil {
-		return nil, err
+		gl.stats.WriteFailure(kind)
+		recordError(span, err)
+		return nil, mapError(err)
+	}
+	return list, nil
+}
+
+// GetUsersInGroups reads the cached members of all the gids in a single pipeline and
+// looks up the others concurrently, caching them.
+func (gl *groupLooker) GetUsersInGroups(ctx context.Context, gids []string, concurrency int) map[string]*pkg.BatchResult {
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.GetUsersInGroups", trace.WithAttributes(attribute.Int("gids", len(gids))))
+	defer span.End()
+	return gl.batch(ctx, span, cachestats.KindGroup, "egroup:", gids, concurrency, gl.wrapped.GetUsersInGroup)
+}
+
+func (gl *groupLooker) GetGroupsOfUsers(ctx context.Context, uids []string, concurrency int) map[string]*pkg.BatchResult {
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.GetGroupsOfUsers", trace.WithAttributes(attribute.Int("uids", len(uids))))
+	defer span.End()
+	return gl.batch(ctx, span, cachestats.KindUser, "u:", uids, concurrency, gl.wrapped.GetUserGroups)
+}
+
+func (gl *groupLooker) GetUsersInComputingGroups(ctx context.Context, gids []string, concurrency int) map[string]*pkg.BatchResult {
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.GetUsersInComputingGroups", trace.WithAttributes(attribute.Int("gids", len(gids))))
+	defer span.End()
+	return gl.batch(ctx, span, cachestats.KindComputingGroup, "unixgroup:", gids, concurrency, gl.wrapped.GetUsersInComputingGroup)
+}
+
+func (gl *groupLooker) GetComputingGroupsOfUsers(ctx context.Context, uids []string, concurrency int) map[string]*pkg.BatchResult {
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.GetComputingGroupsOfUsers", trace.WithAttributes(attribute.Int("uids", len(uids))))
+	defer span.End()
+	return gl.batch(ctx, span, cachestats.KindComputingUser, "unixuser:", uids, concurrency, gl.wrapped.GetUserComputingGroups)
+}
+
+// batch sends one SMEMBERS per id in a single pipeline. Empty lists are never cached, so an
+// empty set is a miss. If the pipeline fails all the ids are misses.
+func (gl *groupLooker) batch(ctx context.Context, span trace.Span, kind cachestats.Kind, prefix string, ids []string, concurrency int,
+	lookup func(ctx context.Context, id string, cached bool) ([]string, error)) map[string]*pkg.BatchResult {
+	pipeline := gl.client.Pipeline()
+	defer pipeline.Close()
+	cmds := make([]*redis.StringSliceCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipeline.SMembers(prefix + id)
+	}
+	done := gl.roundTrip(ctx, "pipeline")
+	_, err := pipeline.Exec()
+	done()
+
+	results := make(map[string]*pkg.BatchResult, len(ids))
+	if err != nil {
+		// the misses could not be cached either, do not put their load on LDAP for nothing
+		recordError(span, err)
+		err = mapError(err)
+		for _, id := range ids {
+			results[id] = &pkg.BatchResult{Err: err}
+		}
+		return results
+	}
+	var misses []string
+	for i, id := range ids {
+		if list, err := cmds[i].Result(); err == nil && len(list) > 0 {
+			gl.stats.Hit(kind)
+			results[id] = &pkg.BatchResult{List: list}
+			continue
+		}
+		gl.stats.Miss(kind)
+		misses = append(misses, id)
+	}
+	span.SetAttributes(attribute.Int("cache.hits", len(ids)-len(misses)))
+
+	fetched := pkg.Batch(ctx, misses, concurrency, func(ctx context.Context, id string) ([]string, error) {
+		return gl.fill(ctx, span, kind, prefix+id, id, lookup)
+	})
+	for id, res := range fetched {
+		results[id] = res
 	}
-	return gids, nil
+	return results
 }
 
 func (gl *groupLooker) Search(ctx context.Context, filter string, cached bool) ([]*pkg.SearchEntry, error) {
 	key := fmt.Sprintf("filter:%s", filter)
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.Search", trace.WithAttributes(attribute.String("filter", filter), attribute.Bool("cached", cached)))
+	defer span.End()
 
 	// check if it is cached
 	if cached {
-		if gl.client.Exists(key).Val() == true {
-			cmd := gl.client.Get(key)
+		if gl.exists(ctx, key) {
+			cmd := gl.get(ctx, key)
 			if cmd.Err() == nil {
 				entries := []*pkg.SearchEntry{}
 				jsonEntries, err := cmd.Result()
 				if err != nil {
-					return nil, err
+					return nil, mapError(err)
 				}
 				err = json.Unmarshal([]byte(jsonEntries), &entries)
 				if err != nil {
 					return nil, err
 				}
+				gl.stats.Hit(cachestats.KindSearch)
+				span.SetAttributes(attribute.Bool("cache.hit", true))
 				return entries, nil
 			}
 		}
+		gl.stats.Miss(cachestats.KindSearch)
+	} else {
+		gl.stats.Refresh(cachestats.KindSearch)
 	}
 
+	start := time.Now()
 	entries, err := gl.wrapped.Search(ctx, filter, false)
+	gl.stats.ObserveLDAP(cachestats.KindSearch, time.Since(start))
 	if err != nil {
+		recordError(span, err)
 		return nil, err
 	}
 
@@ -203,30 +345,108 @@ func (gl *groupLooker) Search(ctx context.Context, filter string, cached bool) (
 		return nil, err
 	}
 
-	cmd := gl.client.Set(key, jsonEntries, time.Second*time.Duration(gl.ttl))
+	done := gl.roundTrip(ctx, "set")
+	cmd := gl.client.Set(key, jsonEntries, gl.expiration())
+	done()
 	err = cmd.Err()
 	if err != nil {
-		return nil, err
+		gl.stats.WriteFailure(cachestats.KindSearch)
+		recordError(span, err)
+		return nil, mapError(err)
 	}
 	return entries, nil
 }
 
+// IsUserInGroup answers with SISMEMBER from the cached members of gid or, else, the cached
+// groups of uid, both include the nested groups. If neither is cached it asks the wrapped
+// GroupLooker and does not cache the answer.
+func (gl *groupLooker) IsUserInGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.IsUserInGroup", trace.WithAttributes(attribute.String("uid", uid), attribute.String("gid", gid), attribute.Bool("cached", cached)))
+	defer span.End()
+	return gl.isMember(ctx, span, fmt.Sprintf("egroup:%s", gid), uid, fmt.Sprintf("u:%s", uid), gid, cached, gl.wrapped.IsUserInGroup)
+}
+
+// IsUserInComputingGroup answers only from the cached members of gid, the set of the
+// computing groups of uid has its direct groups and not the nested ones.
+func (gl *groupLooker) IsUserInComputingGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	ctx, span := tracer.Start(ctx, "redisgrouplooker.IsUserInComputingGroup", trace.WithAttributes(attribute.String("uid", uid), attribute.String("gid", gid), attribute.Bool("cached", cached)))
+	defer span.End()
+	return gl.isMember(ctx, span, fmt.Sprintf("unixgroup:%s", gid), uid, "", gid, cached, gl.wrapped.IsUserInComputingGroup)
+}
+
+// isMember sends EXISTS and SISMEMBER for groupKey, and for userKey unless it is empty, in
+// one MULTI: SISMEMBER answers false for a key expired after a separate EXISTS.
+func (gl *groupLooker) isMember(ctx context.Context, span trace.Span, groupKey, uid, userKey, gid string, cached bool,
+	lookup func(ctx context.Context, uid, gid string, cached bool) (bool, error)) (bool, error) {
+	if cached {
+		keys := [][2]string{{groupKey, uid}}
+		if userKey != "" {
+			keys = append(keys, [2]string{userKey, gid})
+		}
+		pipeline := gl.client.TxPipeline()
+		defer pipeline.Close()
+		exists := make([]*redis.BoolCmd, len(keys))
+		members := make([]*redis.BoolCmd, len(keys))
+		for i, k := range keys {
+			exists[i] = pipeline.Exists(k[0])
+			members[i] = pipeline.SIsMember(k[0], k[1])
+		}
+		done := gl.roundTrip(ctx, "pipeline")
+		_, err := pipeline.Exec()
+		done()
+		if err == nil {
+			for i := range keys {
+				if exists[i].Val() {
+					gl.stats.Hit(cachestats.KindMembership)
+					span.SetAttributes(attribute.Bool("cache.hit", true))
+					return members[i].Val(), nil
+				}
+			}
+		}
+		gl.stats.Miss(cachestats.KindMembership)
+	} else {
+		gl.stats.Refresh(cachestats.KindMembership)
+	}
+
+	start := time.Now()
+	ok, err := lookup(ctx, uid, gid, false)
+	gl.stats.ObserveLDAP(cachestats.KindMembership, time.Since(start))
+	if err != nil {
+		recordError(span, err)
+		return false, err
+	}
+	return ok, nil
+}
+
 func (gl *groupLooker) GetTTLForUser(ctx context.Context, uid string) (time.Duration, error) {
 	key := fmt.Sprintf("u:%s", uid)
-	return gl.client.TTL(key).Result()
+	defer gl.roundTrip(ctx, "ttl")()
+	ttl, err := gl.client.TTL(key).Result()
+	return ttl, mapError(err)
 }
 
 func (gl *groupLooker) GetTTLForGroup(ctx context.Context, gid string) (time.Duration, error) {
 	key := fmt.Sprintf("egroup:%s", gid)
-	return gl.client.TTL(key).Result()
+	defer gl.roundTrip(ctx, "ttl")()
+	ttl, err := gl.client.TTL(key).Result()
+	return ttl, mapError(err)
 }
 
 func (gl *groupLooker) GetTTLForComputingGroup(ctx context.Context, gid string) (time.Duration, error) {
 	key := fmt.Sprintf("unixgroup:%s", gid)
-	return gl.client.TTL(key).Result()
+	defer gl.roundTrip(ctx, "ttl")()
+	ttl, err := gl.client.TTL(key).Result()
+	return ttl, mapError(err)
 }
 
 func (gl *groupLooker) GetTTLForComputingUser(ctx context.Context, gid string) (time.Duration, error) {
 	key := fmt.Sprintf("unixuser:%s", gid)
-	return gl.client.TTL(key).Result()
+	defer gl.roundTrip(ctx, "ttl")()
+	ttl, err := gl.client.TTL(key).Result()
+	return ttl, mapError(err)
+}
+
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
 }
@@ -0,0 +1,180 @@
+package redisgrouplooker
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/cachestats"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type fakeLooker struct {
+	calls   int
+	members []string
+}
+
+func (f *fakeLooker) GetUsersInGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	f.calls++
+	if f.members != nil {
+		return f.members, nil
+	}
+	return []string{"hugo", "labkode"}, nil
+}
+func (f *fakeLooker) GetUserGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"cernbox-admins"}, nil
+}
+func (f *fakeLooker) GetUsersInComputingGroup(ctx context.Context, gid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"hugo"}, nil
+}
+func (f *fakeLooker) GetUserComputingGroups(ctx context.Context, uid string, cached bool) ([]string, error) {
+	f.calls++
+	return []string{"zp"}, nil
+}
+func (f *fakeLooker) GetTTLForUser(ctx context.Context, uid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) GetTTLForGroup(ctx context.Context, gid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) GetTTLForComputingUser(ctx context.Context, uid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) GetTTLForComputingGroup(ctx context.Context, gid string) (time.Duration, error) {
+	return -1, nil
+}
+func (f *fakeLooker) Search(ctx context.Context, filter string, cached bool) ([]*pkg.SearchEntry, error) {
+	f.calls++
+	return []*pkg.SearchEntry{{CN: filter}}, nil
+}
+
+func (f *fakeLooker) IsUserInGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	f.calls++
+	return uid == "hugo", nil
+}
+func (f *fakeLooker) IsUserInComputingGroup(ctx context.Context, uid, gid string, cached bool) (bool, error) {
+	f.calls++
+	return uid == "hugo", nil
+}
+
+// newTestLooker caches in an in-memory Redis server, close stops it.
+func newTestLooker(t *testing.T, ttl int) (gl *groupLooker, fake *fakeLooker, s *miniredis.Miniredis, close func()) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(s.Port())
+	fake = &fakeLooker{}
+	gl = New(s.Host(), port, 0, ttl, "", fake).(*groupLooker)
+	return gl, fake, s, func() {
+		gl.Close()
+		s.Close()
+	}
+}
+
+func TestIsMember(t *testing.T) {
+	ctx := context.Background()
+	gl, fake, s, close := newTestLooker(t, 60)
+	defer close()
+
+	// nothing cached, asked to the wrapped looker without caching the answer
+	for i := 0; i < 2; i++ {
+		if ok, _ := gl.IsUserInGroup(ctx, "hugo", "cernbox-admins", true); !ok {
+			t.Error("expected hugo to be a member")
+		}
+	}
+	if fake.calls != 2 {
+		t.Errorf("expected 2 calls to the wrapped looker, got %d", fake.calls)
+	}
+
+	// answered from the cached members of the group, then from the cached groups of the user
+	gl.GetUsersInGroup(ctx, "cernbox-admins", true)
+	if ok, _ := gl.IsUserInGroup(ctx, "labkode", "cernbox-admins", true); !ok {
+		t.Error("expected labkode to be a member")
+	}
+	gl.GetUserGroups(ctx, "labkode", true)
+	if ok, _ := gl.IsUserInGroup(ctx, "labkode", "it-dep", true); ok {
+		t.Error("expected labkode not to be in it-dep")
+	}
+	if fake.calls != 4 {
+		t.Errorf("expected cached answers, got %d calls", fake.calls)
+	}
+
+	// an expired set is a miss, not a negative answer
+	s.FastForward(61 * time.Second)
+	if ok, _ := gl.IsUserInGroup(ctx, "hugo", "cernbox-admins", true); !ok || fake.calls != 5 {
+		t.Errorf("expected the wrapped looker to answer after the expiration, got %v after %d calls", ok, fake.calls)
+	}
+
+	// the cached computing groups of the user are only the direct ones, the wrapped looker is asked
+	gl.GetUserComputingGroups(ctx, "labkode", true)
+	gl.IsUserInComputingGroup(ctx, "labkode", "zp", true)
+	if fake.calls != 7 {
+		t.Errorf("expected the wrapped looker to be asked, got %d calls", fake.calls)
+	}
+	gl.GetUsersInComputingGroup(ctx, "zp", true)
+	if ok, _ := gl.IsUserInComputingGroup(ctx, "hugo", "zp", true); !ok {
+		t.Error("expected hugo to be in zp")
+	}
+	if fake.calls != 8 {
+		t.Errorf("expected a cached answer, got %d calls", fake.calls)
+	}
+
+	stats := gl.Stats().Snapshot().Kinds[cachestats.KindMembership]
+	if stats.Hits != 3 || stats.Misses != 4 || stats.LDAPLookups != 4 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBatchUnavailable(t *testing.T) {
+	ctx := context.Background()
+	gl, fake, s, close := newTestLooker(t, 60)
+	defer close()
+
+	// one at a time, the fake looker counts without locking
+	results := gl.GetUsersInGroups(ctx, []string{"cernbox-admins", "it-dep"}, 1)
+	if res := results["it-dep"]; len(results) != 2 || res.Err != nil || len(res.List) != 2 {
+		t.Fatalf("unexpected results %+v", results)
+	}
+
+	// without Redis nothing could be cached, LDAP is not asked
+	s.Close()
+	calls := fake.calls
+	results = gl.GetUsersInGroups(ctx, []string{"cernbox-admins", "it-dep"}, 1)
+	unavailable := pkg.NewGroupLookerError(pkg.GroupLookerErrorUnavailable)
+	for gid, res := range results {
+		if !errors.Is(res.Err, unavailable) {
+			t.Errorf("%s: expected unavailable, got %+v", gid, res)
+		}
+	}
+	if len(results) != 2 || fake.calls != calls {
+		t.Errorf("expected 2 errors without lookups, got %d results after %d lookups", len(results), fake.calls-calls)
+	}
+}
+
+func TestRefreshRemovesMembers(t *testing.T) {
+	ctx := context.Background()
+	gl, fake, s, close := newTestLooker(t, 60)
+	defer close()
+
+	gl.GetUsersInGroup(ctx, "cernbox-admins", true)
+	fake.members = []string{"hugo"}
+	if _, err := gl.GetUsersInGroup(ctx, "cernbox-admins", false); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := s.Members("egroup:cernbox-admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0] != "hugo" {
+		t.Errorf("expected the refresh to replace the members, got %v", members)
+	}
+	if ok, _ := gl.IsUserInGroup(ctx, "labkode", "cernbox-admins", true); ok {
+		t.Error("expected labkode not to be a member anymore")
+	}
+}
@@ -0,0 +1,121 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuths = map[string]tls.ClientAuthType{
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+// Config is the TLS configuration of the server. The certificate, the key and the
+// CA of the client certificates are read from files that can be reloaded while
+// running, so renewed certificates are used without a restart.
+type Config struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	minVersion   uint16
+	clientAuth   tls.ClientAuthType
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// New loads the certificate and key, and the client CA when client certificates are
+// verified. minVersion is one of 1.0, 1.1, 1.2 or 1.3 and clientAuth one of none,
+// optional or require.
+func New(certFile, keyFile, clientCAFile, minVersion, clientAuth string) (*Config, error) {
+	version, ok := versions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q", minVersion)
+	}
+	auth, ok := clientAuths[clientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client authentication %q", clientAuth)
+	}
+	if auth != tls.NoClientCert && clientCAFile == "" {
+		return nil, fmt.Errorf("client authentication %q needs a client CA", clientAuth)
+	}
+
+	c := &Config{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		minVersion:   version,
+		clientAuth:   auth,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files again. If any of them is invalid the previous ones are kept.
+func (c *Config) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if c.clientAuth != tls.NoClientCert {
+		data, err := ioutil.ReadFile(c.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", c.clientCAFile)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.clientCAs = pool
+	return nil
+}
+
+// TLSConfig returns the configuration for the http.Server, every handshake
+// uses the files loaded by the last Reload. HTTP/2 and HTTP/1.1 are offered with ALPN,
+// the config of the handshake replaces the one of the server so it has to list them too.
+func (c *Config) TLSConfig() *tls.Config {
+	nextProtos := []string{"h2", "http/1.1"}
+	return &tls.Config{
+		MinVersion:     c.minVersion,
+		NextProtos:     nextProtos,
+		GetCertificate: c.getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   c.minVersion,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*c.cert},
+				ClientAuth:   c.clientAuth,
+				ClientCAs:    c.clientCAs,
+			}, nil
+		},
+	}
+}
+
+func (c *Config) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
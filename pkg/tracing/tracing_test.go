@@ -0,0 +1,43 @@
+package tracing
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		exporter string
+		recorded bool
+	}{
+		{"", false},
+		{"none", false},
+		{"stdout", true},
+		{"otlp", true},
+	}
+	for _, test := range tests {
+		previous := otel.GetTracerProvider()
+		shutdown, err := Init(test.exporter, "localhost:4318", true, "cboxgroupd")
+		if err != nil {
+			t.Errorf("%q: %s", test.exporter, err)
+			continue
+		}
+		// without exporter the spans are not recorded, the global provider is left alone
+		current := otel.GetTracerProvider()
+		if _, ok := current.(*sdktrace.TracerProvider); test.recorded && (!ok || current == previous) {
+			t.Errorf("%q: expected a new SDK tracer provider, got %T", test.exporter, current)
+		}
+		if !test.recorded && current != previous {
+			t.Errorf("%q: expected the tracer provider to be left alone, got %T", test.exporter, current)
+		}
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("%q: error shutting down: %s", test.exporter, err)
+		}
+	}
+
+	if _, err := Init("jaeger", "localhost:4318", true, "cboxgroupd"); err == nil {
+		t.Error("expected an error for an unknown exporter")
+	}
+}
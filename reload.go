@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cernbox/cboxgroupd/handlers"
+	"github.com/cernbox/cboxgroupd/pkg"
+	"github.com/cernbox/cboxgroupd/pkg/clients"
+	"github.com/cernbox/cboxgroupd/pkg/jobs"
+	"github.com/cernbox/cboxgroupd/pkg/jwtauth"
+	"github.com/cernbox/cboxgroupd/pkg/logfile"
+	"github.com/cernbox/cboxgroupd/pkg/policy"
+	"github.com/cernbox/cboxgroupd/pkg/ratelimit"
+	"github.com/cernbox/cboxgroupd/pkg/tlsconfig"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+// restartSettings are only read at startup, a change in any of them needs a restart.
+var restartSettings = []string{
+	"network", "port",
+	"ldaphostname", "ldapport", "ldappagelimit",
+	"redishostname", "redisport", "redisdb", "redispassword",
+	"cachebackend", "boltpath", "memorymaxentries", "memorycleanupinterval",
+	"applog", "httplog", "auditlog", "metricsauth",
+	"jobttl", "updatequeuesize", "batchmaxitems", "batchconcurrency",
+	"authmaxfailures", "authfailurewindow", "ratelimitbackend",
+	"tracingexporter", "tracingendpoint", "tracinginsecure",
+	"tlscert", "tlskey", "tlsminversion", "tlsclientca", "tlsclientauth", "tlsclients",
+	"jwtissuer", "jwtaudience", "jwtjwks", "jwtjwksrefresh", "jwtreadscope", "jwtupdatescope", "jwtadminscope",
+}
+
+// ttlSetter is implemented by the cache backends whose TTL can be changed while running.
+type ttlSetter interface {
+	SetTTL(ttl int)
+}
+
+// liveSettings are the parts of the running server changed on SIGHUP.
+type liveSettings struct {
+	logger   *zap.Logger
+	level    zap.AtomicLevel
+	logs     []*logfile.File
+	clients  *clients.Registry
+	failures *handlers.FailureLimiter
+	policies *policy.Policies
+	limits   *ratelimit.Limiter
+	jwt      *jwtauth.Verifier
+	cache    pkg.GroupLooker
+	queue    *jobs.Queue
+	tls      *tlsconfig.Config
+	startup  map[string]string
+}
+
+func snapshot(keys []string) map[string]string {
+	values := map[string]string{}
+	for _, key := range keys {
+		values[key] = fmt.Sprint(viper.Get(key))
+	}
+	return values
+}
+
+// reload reopens the log files and reloads the TLS certificates and the JWKS.
+// It then applies the live settings of the configuration file: the TTL, the clients,
+// the trusted proxies, the policies, the rate limits, the update concurrency and
+// timeout and the log level.
+// If a setting that needs a restart has changed, or a value is invalid, nothing is applied.
+func (l *liveSettings) reload() error {
+	for _, f := range l.logs {
+		if err := f.Reopen(); err != nil {
+			l.logger.Error("error reopening log file", zap.Error(err))
+		}
+	}
+	if l.tls != nil {
+		if err := l.tls.Reload(); err != nil {
+			l.logger.Error("error reloading TLS certificates", zap.Error(err))
+		}
+	}
+	if l.jwt != nil {
+		if err := l.jwt.Reload(); err != nil {
+			l.logger.Error("error reloading JWKS", zap.Error(err))
+		}
+	}
+
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+
+	var changed []string
+	for key, value := range snapshot(restartSettings) {
+		if value != l.startup[key] {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("changing %s needs a restart", strings.Join(changed, ", "))
+	}
+
+	level := zap.NewAtomicLevel()
+	if err := level.UnmarshalText([]byte(viper.GetString("loglevel"))); err != nil {
+		return err
+	}
+	workers := viper.GetInt("ldapmaxconcurrency")
+	if workers < 1 {
+		return fmt.Errorf("invalid ldapmaxconcurrency %d", workers)
+	}
+
+	apiClients, err := getClients()
+	if err != nil {
+		return err
+	}
+	proxies, err := handlers.ParseProxies(viper.GetStringSlice("trustedproxies"))
+	if err != nil {
+		return err
+	}
+	apiPolicies, err := getPolicies()
+	if err != nil {
+		return err
+	}
+	if err := policy.Validate(apiPolicies); err != nil {
+		return err
+	}
+	rateLimits, err := getRateLimits()
+	if err != nil {
+		return err
+	}
+	if err := ratelimit.Validate(rateLimits); err != nil {
+		return err
+	}
+	// the only setter that can fail, nothing has been applied if it does
+	if err := l.clients.Set(apiClients); err != nil {
+		return err
+	}
+	l.failures.SetTrustedProxies(proxies)
+	l.policies.Set(apiPolicies)
+	l.limits.Set(rateLimits)
+
+	l.level.SetLevel(level.Level())
+	l.queue.SetWorkers(workers)
+	l.queue.SetTimeout(time.Second * time.Duration(viper.GetInt("jobtimeout")))
+	if s, ok := l.cache.(ttlSetter); ok {
+		s.SetTTL(cacheTTL())
+	}
+	return nil
+}
+
+// cacheTTL returns the TTL of the configured cache backend
+func cacheTTL() int {
+	if viper.GetString("cachebackend") == "redis" {
+		return viper.GetInt("redisttl")
+	}
+	return viper.GetInt("cachettl")
+}